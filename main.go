@@ -5,37 +5,66 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha256" // Add this import
+	"crypto/subtle"
+	"crypto/tls"
 	"embed"       // Add this import
 	"io/fs"       // Add this import
+	"encoding/base64"
 	"encoding/hex"  // Add this import
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user" // Add this import
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
 
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf16"
 
+	"github.com/anacrolix/dht/v2"
 	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/iplist"
 	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	infohash_v2 "github.com/anacrolix/torrent/types/infohash-v2"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/lotusdblabs/lotusdb/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 )
 
 //go:embed index.html style.css script.js favicon.ico jassub_dist
@@ -44,11 +73,38 @@ var staticFiles embed.FS // Add this global variable
 // --- Structs for Caching ---
 // cacheEntry holds the torrent and data for calculating download speed.
 type cacheEntry struct {
-	mu            sync.Mutex
-	torrent       *torrent.Torrent
-	prevBytesRead int64
-	prevReadTime  time.Time
-	lastAccessed  time.Time
+	mu             sync.Mutex
+	torrent        *torrent.Torrent
+	prevBytesRead  int64
+	prevReadTime   time.Time
+	lastAccessed   time.Time
+	verifying      bool // True while existing on-disk data is being re-hashed
+	verifiedPieces int  // Pieces re-hashed so far while verifying
+
+	// Pieces raised in priority for the last seek of each open stream.
+	seekWindows map[*seekPrioritizingReader]pieceRange
+
+	prevFileBytes []int64 // BytesCompleted per file index at prevReadTime
+
+	// Speeds computed at prevReadTime, reported until the next sample is due.
+	lastSpeed      float64
+	lastFileSpeeds []float64
+
+	paused           bool                    // Set by /pause, cleared by /resume
+	pausedPriorities []torrent.PiecePriority // File priorities to restore on resume
+
+	dataDir string // Directory holding the torrent's data (downloadDir or a session subdirectory)
+
+	activeStreams   int // Open /stream responses, limited by -max-streams-per-torrent
+	internalStreams int // Those of activeStreams read by ffmpeg/ffprobe, exempt from the limit
+
+	completionNotified bool // The -completion-webhook was called for this torrent
+
+	sniffedTypes map[int]string // Content types detected from the data, by file index
+
+	// When the torrent's metainfo was created, served as Last-Modified by /stream.
+	// Content is immutable per infohash, so this only has to be stable.
+	createdAt time.Time
 }
 
 // --- Structs for API JSON Responses ---
@@ -57,6 +113,7 @@ type FileInfo struct {
 	Size       int64  `json:"size"`
 	SizeHuman  string `json:"size_human"`
 	IsSubtitle bool   `json:"isSubtitle,omitempty"` // New field
+	Streamable bool   `json:"streamable"`           // Has a known video extension
 }
 type Metadata struct {
 	Name           string     `json:"name"`
@@ -71,19 +128,35 @@ type FileStatus struct {
 	Size                int64   `json:"size"`
 	BytesCompleted      int64   `json:"bytesCompleted"`
 	PercentageCompleted float64 `json:"percentageCompleted"`
+	DownloadSpeedBps    float64 `json:"downloadSpeedBps"`
+	DownloadSpeedHuman  string  `json:"downloadSpeedHuman,omitempty"`
 }
 type StatusInfo struct {
-	InfoHash            string       `json:"infoHash"`
-	Name                string       `json:"name"`
-	TotalBytes          int64        `json:"totalBytes"`
-	BytesCompleted      int64        `json:"bytesCompleted"`
-	PercentageCompleted float64      `json:"percentageCompleted"`
-	DownloadSpeedBps    float64      `json:"downloadSpeedBps"`
-	DownloadSpeedHuman  string       `json:"downloadSpeedHuman"`
-	ConnectedPeers      int          `json:"connectedPeers"`
-	Files               []FileStatus `json:"files"`
-	StreamingFileSize   int64        `json:"streamingFileSize,omitempty"`
-	StreamingFileSizeHuman string    `json:"streamingFileSizeHuman,omitempty"`
+	InfoHash               string       `json:"infoHash"`
+	Name                   string       `json:"name"`
+	TotalBytes             int64        `json:"totalBytes"`
+	BytesCompleted         int64        `json:"bytesCompleted"`
+	PercentageCompleted    float64      `json:"percentageCompleted"`
+	DownloadSpeedBps       float64      `json:"downloadSpeedBps"`
+	DownloadSpeedHuman     string       `json:"downloadSpeedHuman"`
+	ConnectedPeers         int          `json:"connectedPeers"`
+	PeersTotal             int          `json:"peersTotal"`      // Known peers, connected or not
+	DownloadedBytes        int64        `json:"downloadedBytes"` // Payload read from peers this session
+	DownloadedHuman        string       `json:"downloadedHuman"`
+	UploadedBytes          int64        `json:"uploadedBytes"` // Payload written to peers this session
+	UploadedHuman          string       `json:"uploadedHuman"`
+	Files                  []FileStatus `json:"files"`
+	Verifying              bool         `json:"verifying,omitempty"`
+	VerifyPercent          float64      `json:"verifyPercent,omitempty"` // Progress of the recheck while verifying
+	Paused                 bool         `json:"paused"`
+	StreamingFileSize      int64        `json:"streamingFileSize,omitempty"`
+	StreamingFileSizeHuman string       `json:"streamingFileSizeHuman,omitempty"`
+
+	// With pieces=true: the torrent's piece count and size, and a base64 bitfield
+	// of completed pieces. See pieceBitfield for the encoding.
+	NumPieces   int    `json:"numPieces,omitempty"`
+	PieceLength int64  `json:"pieceLength,omitempty"`
+	Pieces      string `json:"pieces,omitempty"`
 }
 
 // TorrentClient holds the main torrent client and cache.
@@ -92,15 +165,245 @@ type TorrentClient struct {
 	ctx          context.Context
 	cache        *lru.Cache
 	db           *lotusdb.DB
-	restartChan  chan<- bool
+	restartChan  chan<- bool // true restarts the server, false shuts it down
 	downloadDir  string            // Add downloadDir to TorrentClient
 	vttFileMap   map[string]string // New: Map vttKey (filename) to full path for cleanup
 	vttFileMapMu sync.Mutex        // New: Mutex to protect vttFileMap
 	port         int
+
+	subtitleExtractionAvailable bool // Whether ffmpeg was found at startup
+	indexerURL                  string
+	indexerAPIKey               string
+	transcodeEnabled            bool
+	internalAddr                string       // Loopback address of the internal stream server
+	internalServer              *http.Server // Serves /stream to ffmpeg without public middleware
+	verifyOnReadd               bool
+	verifyOnLoad                bool
+	fetchClient                 *http.Client // Guarded client for user-supplied .torrent URLs
+	bufferSeconds               float64
+	readaheadBytes              int64
+	sequential                  bool // Default for the /stream sequential parameter
+	maxStreamsPerTorrent        int  // Concurrent /stream responses allowed per torrent (0 = unlimited)
+	streamReadTimeout           time.Duration
+	streamBuffers               *sync.Pool // Copy buffers for /stream and /download (nil = net/http's)
+	maxDiskUsage                int64
+	minFreeBytes                uint64
+	completionWebhook           string
+	minFreePercent              float64
+	perSessionDirs              bool
+	sessionStorages             map[string]*sessionStorage // Session data dir -> file storage
+	sessionStoragesMu           sync.Mutex
+	durations                   map[string]float64 // "infohash/path" -> probed duration in seconds (-1 while probing)
+	durationsMu                 sync.Mutex
+	restoreSessionEnabled       bool
+	metadataRetries             int
+	maxDownloadRate             int64
+	maxUploadRate               int64
+	extraTrackers               []string
+	metadataTimeout             time.Duration // How long to wait for torrent info per attempt
+	metadataTTL                 time.Duration // Persisted metainfo unused for longer is deleted; 0 keeps it
+	startTime                   time.Time
+	extractions                 map[string]bool // Log file names of running ffmpeg extractions
+	extractionQueue             []string        // Log file names of extractions waiting for a slot, oldest first
+	extractionSlots             chan struct{}   // Held by running ffmpeg processes; nil when unlimited
+	extractionsMu               sync.Mutex
+	metadataSlots               chan struct{}      // Held by swarm metadata fetches; nil when unlimited
+	infoFetches                 singleflight.Group // Shares getTorrentInfo swarm fetches per infohash
+	torrentAdds                 singleflight.Group // Shares getTorrentFromMagnet cache misses per infohash
+	torrentUses                 map[string]int     // Adds and info-only fetches in flight per infohash
+	torrentUsesMu               sync.Mutex
+	blocklist                   *countingBlocklist // nil without -blocklist
+	metaCipher                  cipher.AEAD        // Encrypts persisted metainfo; nil without -db-encryption-key
+	defaultFileStrategy         string             // One of the FileStrategy constants
+
+	// Session counters for /stats, one per getTorrentFromMagnet lookup tier.
+	cacheHits     atomic.Int64
+	dbHits        atomic.Int64
+	magnetFetches atomic.Int64
+	torrentsAdded atomic.Int64
+
+	persistFailures atomic.Int64 // Metainfo writes abandoned after every retry failed
+}
+
+// lruCacheSize is the number of torrents kept active in memory.
+const lruCacheSize = 2
+
+// sessionKey is the LotusDB key holding the JSON list of recently active infohashes.
+// Infohash keys are hex strings, so this cannot collide with torrent metadata.
+const sessionKey = "session:recent"
+
+// aliasKeyPrefix namespaces the LotusDB entries mapping the truncated v2 infohash
+// of a hybrid torrent to the v1 infohash it is stored under.
+const aliasKeyPrefix = "alias:"
+
+// vttKeyPrefix namespaces the LotusDB entries mapping VTT keys to their file paths.
+const vttKeyPrefix = "vtt:"
+
+// accessKeyPrefix namespaces the LotusDB entries holding when a torrent's
+// persisted metainfo was last used, as Unix seconds, for -metadata-ttl.
+const accessKeyPrefix = "accessed:"
+
+// infoHashKeyPattern matches the LotusDB keys of persisted metainfo.
+var infoHashKeyPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// vttKeyPattern matches the VTT keys handed out by downloadSubtitleHandler:
+// <infohash>_<sha256 of the subtitle path>.vtt
+var vttKeyPattern = regexp.MustCompile(`^[0-9a-f]{40}_[0-9a-f]{64}\.vtt$`)
+
+// Upload modes for Options.UploadMode. Peers reward uploaders (tit-for-tat), so
+// restricting upload saves outbound bandwidth at the cost of download speed.
+const (
+	UploadModeNormal     = "normal"     // Upload to peers as the client sees fit
+	UploadModeReciprocal = "reciprocal" // Only upload to peers that reciprocate
+	UploadModeNone       = "none"       // Never upload
+)
+
+// Default-file strategies for Options.DefaultFileStrategy: which file /stream and
+// friends pick when a request gives neither 'path' nor 'index'.
+const (
+	FileStrategyLargest      = "largest"            // The largest file
+	FileStrategyFirstVideo   = "first-video"        // The first file, in torrent order, with a known video extension
+	FileStrategyAlphabetical = "alphabetical-first" // The file whose path sorts first
+)
+
+// Options holds the settings used to construct a TorrentClient.
+type Options struct {
+	DownloadDir string
+	Port        int
+
+	// SubtitleExtractionAvailable reports whether ffmpeg is installed.
+	// When false, extraction requests are rejected with 503.
+	SubtitleExtractionAvailable bool
+
+	// IndexerURL is the base URL of a Torznab-compatible indexer (e.g. Jackett) used by /search.
+	// Search is disabled when empty.
+	IndexerURL    string
+	IndexerAPIKey string
+
+	// EnableTranscode serves /transcode, which re-encodes files to H.264/AAC
+	// with ffmpeg. It is off by default because of the CPU cost.
+	EnableTranscode bool
+
+	// VerifyOnReadd re-hashes a torrent's data in the background when it is
+	// re-added and its files are already fully present on disk.
+	VerifyOnReadd bool
+
+	// VerifyOnLoad re-hashes a torrent's data in the background whenever it is
+	// added with any of its files already on disk, so corrupted data isn't served
+	// just because the piece completion store marks it complete.
+	VerifyOnLoad bool
+
+	// UploadMode limits how much the client uploads to peers; see the UploadMode constants.
+	UploadMode string
+
+	// AllowPrivateFetch lets /fetch-torrent-url download from private, loopback
+	// and link-local addresses. Off by default to prevent SSRF.
+	AllowPrivateFetch bool
+
+	// BufferSeconds is how much playback time to read ahead of the stream position,
+	// converted to bytes using the file's probed bitrate. Zero keeps the library default.
+	BufferSeconds float64
+
+	// ReadaheadBytes is the byte window read and prioritized ahead of the stream
+	// position when BufferSeconds can't be applied. Zero keeps the library default.
+	ReadaheadBytes int64
+
+	// StreamBufferSize is the size of the pooled buffers that /stream and /download
+	// copy torrent data through. Zero uses net/http's 32KB copy buffers.
+	StreamBufferSize int
+
+	// RestoreSession re-adds the torrents that were active before the last
+	// shutdown or restart, using their persisted metadata.
+	RestoreSession bool
+
+	// MetadataRetries is how many extra metadata waits a magnet gets when a timeout
+	// looks like a transient network failure rather than a dead torrent.
+	MetadataRetries int
+
+	// MaxDownloadRate and MaxUploadRate cap peer traffic in bytes per second. Zero means unlimited.
+	MaxDownloadRate int64
+	MaxUploadRate   int64
+
+	// ExtraTrackers are announce URLs appended to every torrent's tracker list.
+	ExtraTrackers []string
+
+	// MetadataTimeout is how long to wait for a magnet's info per attempt. Defaults to 30s.
+	MetadataTimeout time.Duration
+
+	// MetadataTTL is how long persisted metainfo is kept after it was last used;
+	// the cleanup sweep deletes older entries. Zero keeps it forever.
+	MetadataTTL time.Duration
+
+	// Sequential makes streams fetch pieces roughly in playback order by default.
+	// Requests can override it with the sequential query parameter.
+	Sequential bool
+
+	// CompletionWebhook is a URL that receives a JSON POST when an active torrent
+	// finishes downloading. Disabled when empty.
+	CompletionWebhook string
+
+	// MinFreeBytes and MinFreePercent refuse to add torrents while the download
+	// directory's filesystem has less free space. Zero disables a check.
+	MinFreeBytes   uint64
+	MinFreePercent float64
+
+	// MaxStreamsPerTorrent caps concurrent /stream responses per torrent; further
+	// requests get 429. Zero means unlimited.
+	MaxStreamsPerTorrent int
+
+	// PerSessionDirs stores the data and subtitles of requests carrying an
+	// X-Session-ID header under DownloadDir/<sessionID>/.
+	PerSessionDirs bool
+
+	// ConnsPerTorrent caps established peer connections per torrent (default 100).
+	// HalfOpenConnsPerTorrent and TotalHalfOpenConns cap connection attempts still
+	// in progress, per torrent and overall. Zero keeps the library default.
+	ConnsPerTorrent         int
+	HalfOpenConnsPerTorrent int
+	TotalHalfOpenConns      int
+
+	// DisableUTP, DisableTCP and DisableIPv6 turn off peer transports and address
+	// families that break on some networks. At least one transport must remain.
+	DisableUTP  bool
+	DisableTCP  bool
+	DisableIPv6 bool
+
+	// Blocklist is the path of a P2P (PeerGuardian text) or eMule .dat IP filter.
+	// Peers in its ranges are never connected to. Empty disables filtering.
+	Blocklist string
+
+	// StreamReadTimeout ends a /stream or /download response when a read from the
+	// torrent returns no data for this long, so players can retry. Zero disables it.
+	StreamReadTimeout time.Duration
+
+	// MaxDiskUsage caps the bytes on disk of all cached torrents. The cleanup
+	// sweep deletes the least recently used torrents' data above it. Zero disables it.
+	MaxDiskUsage int64
+
+	// DBEncryptionKey, when set, is the AES key (16, 24 or 32 bytes) used to
+	// encrypt metainfo stored in LotusDB with AES-GCM.
+	DBEncryptionKey []byte
+
+	// NoPersist skips LotusDB entirely: nothing is written to disk except torrent
+	// data, and torrent info is always fetched from the swarm.
+	NoPersist bool
+
+	// MaxConcurrentExtractions caps how many ffmpeg subtitle extractions run at
+	// once; later ones wait in a queue. Zero means unlimited.
+	MaxConcurrentExtractions int
+
+	// MaxConcurrentMetadata caps how many torrents fetch their info from the
+	// swarm at once; later fetches wait for a slot. Zero means unlimited.
+	MaxConcurrentMetadata int
+
+	// DefaultFileStrategy picks the file streamed when a request doesn't select
+	// one; see the FileStrategy constants. Empty means FileStrategyLargest.
+	DefaultFileStrategy string
 }
 
 // NewTorrentClient initializes the application.
-func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<- bool, port int) (*TorrentClient, error) {
+func NewTorrentClient(ctx context.Context, opts Options, restartChan chan<- bool) (*TorrentClient, error) {
+	downloadDir := opts.DownloadDir
 	http.DefaultClient.Transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment, DialContext: (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
 		MaxIdleConns: 100, IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second,
@@ -111,11 +414,79 @@ func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<
 	cfg.DataDir = downloadDir
 	// --- Performance Tuning ---
 	cfg.EstablishedConnsPerTorrent = 100 // Increase connection limit
+	if opts.ConnsPerTorrent > 0 {
+		cfg.EstablishedConnsPerTorrent = opts.ConnsPerTorrent
+	}
+	if opts.HalfOpenConnsPerTorrent > 0 {
+		cfg.HalfOpenConnsPerTorrent = opts.HalfOpenConnsPerTorrent
+	}
+	if opts.TotalHalfOpenConns > 0 {
+		cfg.TotalHalfOpenConns = opts.TotalHalfOpenConns
+	}
+	slog.Info("Peer connection limits", "connsPerTorrent", cfg.EstablishedConnsPerTorrent, "halfOpenConnsPerTorrent", cfg.HalfOpenConnsPerTorrent, "totalHalfOpenConns", cfg.TotalHalfOpenConns)
+
+	// --- Networking ---
+	if opts.DisableUTP && opts.DisableTCP {
+		return nil, errors.New("cannot disable both uTP and TCP: no peer transport would remain")
+	}
+	cfg.DisableUTP = opts.DisableUTP
+	cfg.DisableTCP = opts.DisableTCP
+	cfg.DisableIPv6 = opts.DisableIPv6
+	slog.Info("Peer networking", "utp", !cfg.DisableUTP, "tcp", !cfg.DisableTCP, "ipv6", !cfg.DisableIPv6)
+
+	// --- IP Blocklist ---
+	// Loaded on every client start, so /restart picks up an updated file.
+	var blocklist *countingBlocklist
+	if opts.Blocklist != "" {
+		ranges, err := loadBlocklist(opts.Blocklist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load blocklist %s: %w", opts.Blocklist, err)
+		}
+		blocklist = &countingBlocklist{Ranger: ranges}
+		cfg.IPBlocklist = blocklist
+		slog.Info("Loaded IP blocklist", "path", opts.Blocklist, "ranges", ranges.NumRanges())
+	}
+
+	// --- Rate Limiting ---
+	if opts.MaxDownloadRate > 0 {
+		// A zero burst lets the client pick one large enough for its reads.
+		cfg.DownloadRateLimiter = rate.NewLimiter(rate.Limit(opts.MaxDownloadRate), 0)
+		slog.Info("Download rate limited", "rate", humanReadableSpeed(float64(opts.MaxDownloadRate)))
+	}
+	if opts.MaxUploadRate > 0 {
+		cfg.UploadRateLimiter = rate.NewLimiter(rate.Limit(opts.MaxUploadRate), 0)
+		slog.Info("Upload rate limited", "rate", humanReadableSpeed(float64(opts.MaxUploadRate)))
+	}
+
+	// --- Upload Limiting ---
+	switch opts.UploadMode {
+	case "", UploadModeNormal:
+	case UploadModeReciprocal:
+		cfg.DisableAggressiveUpload = true
+		slog.Info("Upload mode: reciprocal (only uploading to peers that upload to us)")
+	case UploadModeNone:
+		cfg.NoUpload = true
+		slog.Info("Upload mode: none (never sending data to peers; download rates may suffer)")
+	default:
+		return nil, fmt.Errorf("invalid upload mode %q (expected %s, %s or %s)", opts.UploadMode, UploadModeNormal, UploadModeReciprocal, UploadModeNone)
+	}
+
+	switch opts.DefaultFileStrategy {
+	case "":
+		opts.DefaultFileStrategy = FileStrategyLargest
+	case FileStrategyLargest, FileStrategyFirstVideo, FileStrategyAlphabetical:
+	default:
+		return nil, fmt.Errorf("invalid default file strategy %q (expected %s, %s or %s)", opts.DefaultFileStrategy, FileStrategyLargest, FileStrategyFirstVideo, FileStrategyAlphabetical)
+	}
 
 	client, err := torrent.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
+	slog.Info("Torrent client listening for peers (forward this port for better connectivity)", "port", client.LocalPort())
+	for _, addr := range client.ListenAddrs() {
+		slog.Info("Torrent client listen address", "network", addr.Network(), "addr", addr.String())
+	}
 
 	// Resolve absolute path for downloadDir
 	absDownloadDir, err := filepath.Abs(downloadDir)
@@ -124,39 +495,53 @@ func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<
 	}
 
 	// --- LotusDB Initialization ---
-	dbPath := filepath.Join(absDownloadDir, "lotusdb_meta")
-	if err := os.MkdirAll(dbPath, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create lotusdb directory: %w", err)
-	}
-	opts := lotusdb.DefaultOptions
-	opts.DirPath = dbPath
-	var db *lotusdb.DB
-	for i := 0; i < 5; i++ {
-		db, err = lotusdb.Open(opts)
-		if err == nil {
-			break
+	var metaCipher cipher.AEAD
+	if len(opts.DBEncryptionKey) > 0 {
+		block, err := aes.NewCipher(opts.DBEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database encryption key: %w", err)
 		}
-		log.Printf("Failed to open lotusdb, retrying... (%d/5): %v", i+1, err)
-		if strings.Contains(err.Error(), "the database directory is used by another process") {
-			lockFilePath := filepath.Join(opts.DirPath, "FLOCK")
-			log.Printf("Database is locked. Attempting to remove lock file: %s", lockFilePath)
-			if removeErr := os.Remove(lockFilePath); removeErr != nil {
-				log.Printf("Failed to remove lock file: %v", removeErr)
-			}
+		if metaCipher, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("failed to set up database encryption: %w", err)
 		}
-		time.Sleep(1 * time.Second)
+		slog.Info("Encrypting persisted torrent metadata")
 	}
-	if err != nil {
-		return nil, fmt.Errorf("failed to open lotusdb after 5 retries: %w", err)
+	var db *lotusdb.DB
+	if opts.NoPersist {
+		slog.Info("Metadata persistence is disabled; torrent info is fetched from the swarm after every restart")
+	} else if db, err = openMetadataDB(absDownloadDir); err != nil {
+		return nil, err
 	}
 	// --- End LotusDB Initialization ---
 
-	tc := &TorrentClient{client: client, ctx: ctx, db: db, restartChan: restartChan, downloadDir: absDownloadDir, vttFileMap: make(map[string]string), port: port}
+	tc := &TorrentClient{client: client, ctx: ctx, db: db, restartChan: restartChan, downloadDir: absDownloadDir, vttFileMap: make(map[string]string), port: opts.Port,
+		subtitleExtractionAvailable: opts.SubtitleExtractionAvailable, indexerURL: opts.IndexerURL, indexerAPIKey: opts.IndexerAPIKey, transcodeEnabled: opts.EnableTranscode,
+		verifyOnReadd: opts.VerifyOnReadd, verifyOnLoad: opts.VerifyOnLoad, fetchClient: newFetchClient(opts.AllowPrivateFetch),
+		bufferSeconds: opts.BufferSeconds, readaheadBytes: opts.ReadaheadBytes, sequential: opts.Sequential, maxStreamsPerTorrent: opts.MaxStreamsPerTorrent, streamReadTimeout: opts.StreamReadTimeout, maxDiskUsage: opts.MaxDiskUsage, minFreeBytes: opts.MinFreeBytes, completionWebhook: opts.CompletionWebhook, minFreePercent: opts.MinFreePercent, perSessionDirs: opts.PerSessionDirs, sessionStorages: make(map[string]*sessionStorage), durations: make(map[string]float64), extractions: make(map[string]bool), torrentUses: make(map[string]int), restoreSessionEnabled: opts.RestoreSession,
+		metadataRetries: opts.MetadataRetries, maxDownloadRate: opts.MaxDownloadRate, maxUploadRate: opts.MaxUploadRate,
+		extraTrackers: opts.ExtraTrackers, metadataTimeout: opts.MetadataTimeout, metadataTTL: opts.MetadataTTL, blocklist: blocklist, metaCipher: metaCipher, defaultFileStrategy: opts.DefaultFileStrategy, startTime: time.Now()}
+	if tc.metadataTimeout <= 0 {
+		tc.metadataTimeout = 30 * time.Second
+	}
+	if opts.MaxConcurrentExtractions > 0 {
+		tc.extractionSlots = make(chan struct{}, opts.MaxConcurrentExtractions)
+	}
+	if opts.MaxConcurrentMetadata > 0 {
+		tc.metadataSlots = make(chan struct{}, opts.MaxConcurrentMetadata)
+	}
+	if opts.StreamBufferSize > 0 {
+		size := opts.StreamBufferSize
+		tc.streamBuffers = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+	}
 
 	// --- LRU Cache Initialization ---
-	lruCache, err := lru.NewWithEvict(2, func(key interface{}, value interface{}) {
+	lruCache, err := lru.NewWithEvict(lruCacheSize, func(key interface{}, value interface{}) {
 		if entry, ok := value.(*cacheEntry); ok {
-			log.Printf("Evicting torrent from LRU cache: %s", entry.torrent.Name())
+			slog.Info("Evicting torrent from LRU cache", "infoHash", entry.torrent.InfoHash().HexString(), "name", entry.torrent.Name())
+			metricCacheEvictions.Inc()
 			entry.torrent.Drop()
 			tc.cleanupTorrentAssociatedFiles(entry.torrent.InfoHash().HexString()) // Clean up associated files
 		}
@@ -167,10 +552,14 @@ func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<
 	tc.cache = lruCache
 	// --- End LRU Cache Initialization ---
 
-	return tc, nil
-}
+	tc.loadVttFileMap()
 
+	if opts.RestoreSession {
+		tc.restoreSession()
+	}
 
+	return tc, nil
+}
 
 func sanitize(s string) string {
 	// Replace a set of special characters with underscores.
@@ -181,780 +570,5772 @@ func sanitize(s string) string {
 }
 
 // --- Middleware ---
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the origin from the request header
-		origin := r.Header.Get("Origin")
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		} else {
-			// Fallback to * if no origin is provided (e.g., for same-origin requests or direct access)
-			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+// parseAllowedOrigins splits the comma-separated -allowed-origins flag value.
+// An empty value returns nil, which selects development mode in corsMiddleware.
+func parseAllowedOrigins(value string) []string {
+	var origins []string
+	for _, origin := range strings.Split(value, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// corsMiddleware returns a middleware that sets CORS headers. Only origins in
+// allowedOrigins are echoed back ("*" allows any origin explicitly). When
+// allowedOrigins is empty the request origin is always reflected, which is
+// only suitable for development.
+func corsMiddleware(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowAll := false
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			allowAll = true
 		}
+		allowed[origin] = true
+	}
+	devMode := len(allowedOrigins) == 0
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Get the origin from the request header
+			origin := r.Header.Get("Origin")
+			switch {
+			case devMode && origin != "":
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			case devMode || allowAll:
+				// Fallback to * if no origin is provided (e.g., for same-origin requests or direct access)
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			case origin != "" && allowed[origin]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Add("Vary", "Origin")
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Filename, X-Filesize, X-Content-Type, X-Session-ID") // Added X- headers to allowed headers
+			w.Header().Set("Access-Control-Expose-Headers", "X-Filename, X-Filesize, X-Content-Type")
+			w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin") // Add Referrer-Policy header
 
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Filename, X-Filesize, X-Content-Type") // Added X- headers to allowed headers
-		w.Header().Set("Access-Control-Expose-Headers", "X-Filename, X-Filesize, X-Content-Type")
-		w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin") // Add Referrer-Policy header
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
+// authCookieName is the cookie set after a successful access_token login so that
+// the browser UI, <video> and <track> requests keep working without the query param.
+const authCookieName = "rsd_access_token"
+
+// authMiddleware requires a bearer token on every request. The token may be sent as
+// "Authorization: Bearer <token>", as an access_token query parameter (for media
+// elements that can't set headers), or via the cookie set after a query-param login.
+// It is a no-op when token is empty.
+func authMiddleware(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS preflight requests never carry credentials.
 		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tokenMatches(token, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if tokenMatches(token, r.URL.Query().Get("access_token")) {
+			http.SetCookie(w, &http.Cookie{Name: authCookieName, Value: token, Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode})
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(authCookieName); err == nil && tokenMatches(token, cookie.Value) {
+			next.ServeHTTP(w, r)
 			return
 		}
-		next.ServeHTTP(w, r)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rsd"`)
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
 	})
 }
 
-// --- Helper Functions ---
-func (tc *TorrentClient) getTorrentFromMagnet(magnetLink string) (*torrent.Torrent, error) {
-	spec, err := metainfo.ParseMagnetURI(magnetLink)
-	if err != nil {
-		return nil, fmt.Errorf("invalid magnet link: %w", err)
-	}
-	spec.DisplayName = sanitize(spec.DisplayName)
-	infoHash := spec.InfoHash.HexString()
+func tokenMatches(expected, given string) bool {
+	return given != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(given)) == 1
+}
 
-	// 1. Check in-memory LRU cache
-	if val, found := tc.cache.Get(infoHash); found {
-		log.Printf("Using in-memory cached torrent for infohash: %s", infoHash)
-		entry := val.(*cacheEntry)
-		entry.mu.Lock()
-		entry.lastAccessed = time.Now()
-		entry.mu.Unlock()
-		return entry.torrent, nil
-	}
+// gzipResponseWriter compresses the response body once the handler has committed
+// to a compressible, full (non-partial) response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
 
-	// 2. Check LotusDB for persisted metadata
-	if metaBytes, err := tc.db.Get([]byte(infoHash)); err == nil {
-		log.Printf("Found metadata in LotusDB for infohash: %s", infoHash)
-		mi, err := metainfo.Load(bytes.NewReader(metaBytes))
-		if err != nil {
-			log.Printf("Error loading metadata from LotusDB: %v. Falling back to magnet.", err)
-		} else {
-			t, err := tc.client.AddTorrent(mi)
-			if err != nil {
-				return nil, fmt.Errorf("failed to add torrent from cached metadata: %w", err)
-			}
-			<-t.GotInfo() // Should be immediate
-			log.Printf("Torrent info loaded from DB for: %s", t.Name())
-			entry := &cacheEntry{torrent: t, prevReadTime: time.Now(), lastAccessed: time.Now()}
-			tc.cache.Add(infoHash, entry)
-			return t, nil
-		}
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
 	}
-
-	// 3. Fetch from magnet link as a last resort
-	log.Printf("Adding magnet link to client: %s", magnetLink)
-	t, err := tc.client.AddMagnet(spec.String())
-	if err != nil {
-		return nil, fmt.Errorf("failed to add magnet link: %w", err)
+	g.wroteHeader = true
+	h := g.Header()
+	if code == http.StatusOK && h.Get("Content-Encoding") == "" && isCompressibleContentType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
 	}
+	g.ResponseWriter.WriteHeader(code)
+}
 
-	log.Println("Waiting for torrent info...")
-	select {
-	case <-t.GotInfo():
-		log.Printf("Torrent info received for: %s", t.Name())
-
-		// Persist metadata to LotusDB
-		var buf bytes.Buffer
-		mi := t.Metainfo()
-		if err := mi.Write(&buf); err != nil {
-			log.Printf("Error writing metainfo to buffer for infohash %s: %v", infoHash, err)
-		} else {
-			if err := tc.db.Put([]byte(infoHash), buf.Bytes()); err != nil {
-				log.Printf("Error saving metainfo to LotusDB for infohash %s: %v", infoHash, err)
-			} else {
-				log.Printf("Successfully saved metadata to LotusDB for infohash: %s", infoHash)
-			}
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
 		}
-		entry := &cacheEntry{torrent: t, prevReadTime: time.Now(), lastAccessed: time.Now()}
-		tc.cache.Add(infoHash, entry)
-		return t, nil
-	case <-tc.ctx.Done():
-		return nil, tc.ctx.Err()
-	case <-time.After(30 * time.Second):
-		log.Printf("Timeout waiting for torrent info for infohash: %s", infoHash)
-		t.Drop()
-		return nil, errors.New("timeout getting torrent info")
+		g.WriteHeader(http.StatusOK)
 	}
+	if g.gz != nil {
+		return g.gz.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
 }
 
-func humanReadableSize(bytes int64) string {
-	const unit = 1024
-	if bytes < unit {
-		return fmt.Sprintf("%d B", bytes)
+func (g *gzipResponseWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
 	}
-	div, exp := int64(unit), 0
-	for n := bytes / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
-	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-func humanReadableSpeed(bytesPerSecond float64) string {
-	return humanReadableSize(int64(bytesPerSecond)) + "/s"
+func (g *gzipResponseWriter) Close() error {
+	if g.gz != nil {
+		return g.gz.Close()
+	}
+	return nil
 }
 
-func getFileToStream(t *torrent.Torrent, index int) *torrent.File {
-	files := t.Files()
-	if index >= 0 && index < len(files) {
-		return files[index]
-	}
-	var largestFile *torrent.File
-	var largestSize int64
-	for _, file := range files {
-		if file.Length() > largestSize {
-			largestFile = file
-			largestSize = file.Length()
+func isCompressibleContentType(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json"
+}
+
+// gzipMiddleware compresses text and JSON responses (VTT, ASS, logs, file lists,
+// status) for clients that accept gzip. Range requests are passed through
+// untouched; /stream serves already-compressed media and is never wrapped.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
 		}
-	}
-	return largestFile
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
 }
 
-func getContentType(filename string) string {
-	switch {
-	case strings.HasSuffix(filename, ".mp4"):
-		return "video/mp4"
-	case strings.HasSuffix(filename, ".mkv"):
-		return "video/x-matroska"
-	default:
-		return "application/octet-stream"
-	}
+// --- Helper Functions ---
+
+// writeJSONError writes an API error as {"error": msg} with the given status code.
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
 }
 
-// --- HTTP Handlers (DEFINED ONLY ONCE) ---
+// --- Per-Session Directories ---
 
-// ***************************************************************
-// ***               START OF UPDATED FUNCTION                   ***
-// ***************************************************************
+// sessionIDHeader selects the session subdirectory when -per-session-dirs is set.
+// Media elements can't send headers, so the sessionId query parameter is accepted too.
+const sessionIDHeader = "X-Session-ID"
 
-func (tc *TorrentClient) streamHandler(w http.ResponseWriter, r *http.Request) {
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
-		return
+// sessionIDPattern restricts session IDs to tokens that are safe as a directory name.
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// reservedSessionIDs are names the server itself uses in the download directory.
+var reservedSessionIDs = map[string]bool{"lotusdb_meta": true}
+
+// requestDataDir returns the directory for a request's torrent data and subtitle
+// files: downloadDir, or its session subdirectory with -per-session-dirs. It writes
+// an error response and returns false for an invalid session ID. The directory
+// isn't created here; see addToClient and ensureDataDir.
+func (tc *TorrentClient) requestDataDir(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if !tc.perSessionDirs {
+		return tc.downloadDir, true
+	}
+	sessionID := r.Header.Get(sessionIDHeader)
+	if sessionID == "" {
+		sessionID = r.URL.Query().Get("sessionId")
+	}
+	if sessionID == "" {
+		return tc.downloadDir, true
 	}
+	if !sessionIDPattern.MatchString(sessionID) {
+		writeJSONError(w, http.StatusBadRequest, "Invalid session ID: use 1-64 letters, digits, '-' or '_'")
+		return "", false
+	}
+	if reservedSessionIDs[sessionID] {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid session ID: %q is reserved", sessionID))
+		return "", false
+	}
+	return filepath.Join(tc.downloadDir, sessionID), true
+}
+
+// ensureDataDir creates a session directory before a subtitle, VTT or thumbnail
+// file is written to it, since the request's torrent may be active elsewhere.
+func (tc *TorrentClient) ensureDataDir(dataDir string) error {
+	if dataDir == tc.downloadDir {
+		return nil
+	}
+	return os.MkdirAll(dataDir, 0755)
+}
+
+// sessionStorage is the file storage of a session directory, shared by the
+// torrents added to it.
+type sessionStorage struct {
+	storage.ClientImplCloser
+	torrents int // Torrents in the client using it; it is closed when this reaches 0
+}
 
-	t, err := tc.getTorrentFromMagnet(magnetLink)
+// addToClient adds tspec to the client with its data stored in dataDir. A session
+// directory is created, and its storage opened, only when a torrent is added to
+// it, and the storage is closed again once its last torrent is dropped.
+func (tc *TorrentClient) addToClient(tspec *torrent.TorrentSpec, dataDir string) (*torrent.Torrent, error) {
+	if dataDir == "" || dataDir == tc.downloadDir {
+		t, _, err := tc.client.AddTorrentSpec(tspec)
+		return t, err
+	}
+	st, err := tc.acquireSessionStorage(dataDir)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	if len(t.Files()) == 0 {
-		http.Error(w, "No files in torrent", http.StatusNotFound)
-		return
+	tspec.Storage = st
+	t, isNew, err := tc.client.AddTorrentSpec(tspec)
+	if err != nil || !isNew {
+		// Failed, or already in the client with the storage it was added with.
+		tc.releaseSessionStorage(dataDir)
+		return t, err
 	}
+	go func() {
+		<-t.Closed()
+		tc.releaseSessionStorage(dataDir)
+	}()
+	return t, nil
+}
 
-	indexStr := r.URL.Query().Get("index")
-	index, err := strconv.Atoi(indexStr)
-	if err != nil {
-		index = -1 // Will select the largest file by default
+// acquireSessionStorage returns the storage of dataDir for one more torrent,
+// creating the directory and opening the storage if no torrent uses it yet.
+func (tc *TorrentClient) acquireSessionStorage(dataDir string) (*sessionStorage, error) {
+	tc.sessionStoragesMu.Lock()
+	defer tc.sessionStoragesMu.Unlock()
+	if st, ok := tc.sessionStorages[dataDir]; ok {
+		st.torrents++
+		return st, nil
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
 	}
+	st := &sessionStorage{ClientImplCloser: storage.NewFile(dataDir), torrents: 1}
+	tc.sessionStorages[dataDir] = st
+	return st, nil
+}
 
-	file := getFileToStream(t, index)
-	if file == nil {
-		http.Error(w, "Could not find a file in the torrent to stream", http.StatusInternalServerError)
+// releaseSessionStorage undoes acquireSessionStorage, closing the storage and its
+// piece-completion database when no torrent uses it any more.
+func (tc *TorrentClient) releaseSessionStorage(dataDir string) {
+	tc.sessionStoragesMu.Lock()
+	defer tc.sessionStoragesMu.Unlock()
+	st, ok := tc.sessionStorages[dataDir]
+	if !ok {
 		return
 	}
+	if st.torrents--; st.torrents > 0 {
+		return
+	}
+	delete(tc.sessionStorages, dataDir)
+	if err := st.Close(); err != nil {
+		slog.Error("Error closing session storage", "path", dataDir, "err", err)
+	}
+}
 
-	filename := filepath.Base(file.DisplayPath())
-	fileSize := file.Length()
-	contentType := getContentType(filename)
-
-	log.Printf("Streaming file: %s (size: %d bytes)", filename, fileSize)
-
-	// --- START of Manual Range Request Handling (from old code) ---
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"; filename*=UTF-8''%s", filename, url.QueryEscape(filename)))
-	w.Header().Set("X-Filename", filename)
-	w.Header().Set("X-Filesize", strconv.FormatInt(fileSize, 10))
-	w.Header().Set("X-Content-Type", contentType)
-	w.Header().Set("Accept-Ranges", "bytes")
+// errNotMagnet is returned by normalizeMagnetLink for input that is neither a
+// magnet URI nor a bare infohash.
+var errNotMagnet = errors.New("not a magnet link: expected 'magnet:?xt=urn:btih:...', a 40-character hex / 32-character base32 infohash or a 64-character hex v2 infohash")
 
-	rangeHeader := r.Header.Get("Range")
-	var start, end int64
-	var contentLength int64
+var (
+	hexInfoHashPattern    = regexp.MustCompile(`^[0-9a-fA-F]{40}$`)
+	base32InfoHashPattern = regexp.MustCompile(`^[a-zA-Z2-7]{32}$`)
+	v2InfoHashPattern     = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+)
 
-	if rangeHeader != "" {
-		fmt.Sscanf(rangeHeader, "bytes=%d-%d", &start, &end)
-		if end == 0 || end >= fileSize {
-			end = fileSize - 1
-		}
-		contentLength = end - start + 1
+// normalizeMagnetLink turns user input into a magnet URI. A bare hex or base32
+// infohash, as often copied on its own, is wrapped in a minimal magnet link.
+// Magnets may carry a v1 (btih) infohash, a v2 (btmh) infohash or both.
+func normalizeMagnetLink(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	switch {
+	case hexInfoHashPattern.MatchString(raw):
+		return "magnet:?xt=urn:btih:" + strings.ToLower(raw), nil
+	case base32InfoHashPattern.MatchString(raw):
+		return "magnet:?xt=urn:btih:" + strings.ToUpper(raw), nil
+	case v2InfoHashPattern.MatchString(raw):
+		// A BitTorrent v2 infohash: a SHA-256 multihash (code 0x12, length 0x20).
+		return "magnet:?xt=urn:btmh:1220" + strings.ToLower(raw), nil
+	case strings.HasPrefix(strings.ToLower(raw), "http://"), strings.HasPrefix(strings.ToLower(raw), "https://"):
+		return "", fmt.Errorf("%w (for a link to a .torrent file, use /fetch-torrent-url)", errNotMagnet)
+	case !strings.HasPrefix(strings.ToLower(raw), "magnet:"):
+		return "", errNotMagnet
+	}
+	m, err := metainfo.ParseMagnetV2Uri(raw)
+	if err != nil {
+		return "", fmt.Errorf("malformed magnet link: %w", err)
+	}
+	if !m.InfoHash.Ok && !m.V2InfoHash.Ok {
+		return "", errors.New("malformed magnet link: missing 'urn:btih:' or 'urn:btmh:' infohash")
+	}
+	return raw, nil
+}
 
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
-		w.WriteHeader(http.StatusPartialContent) // Send 206 Partial Content status
-	} else {
-		// No range request, so stream the whole file
-		start = 0
-		end = fileSize - 1
-		contentLength = fileSize
-		w.WriteHeader(http.StatusOK) // Send 200 OK status
+// magnetParam reads and normalizes the 'url' query parameter, writing a 400
+// response and returning false if it is missing or invalid.
+func magnetParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	raw := r.URL.Query().Get("url")
+	if raw == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'url' query parameter")
+		return "", false
+	}
+	magnetLink, err := normalizeMagnetLink(raw)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return "", false
 	}
+	return magnetLink, true
+}
 
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+// getTorrentFromMagnet returns the active torrent for magnetLink, adding it from
+// persisted metadata or the swarm if needed. A newly added torrent stores its data
+// in dataDir; a torrent that is already active keeps its directory. trackers are
+// appended to the configured -extra-trackers for this torrent.
+func (tc *TorrentClient) getTorrentFromMagnet(magnetLink, dataDir string, trackers ...string) (*torrent.Torrent, error) {
+	spec, err := metainfo.ParseMagnetV2Uri(magnetLink)
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	spec.DisplayName = sanitize(spec.DisplayName)
+	infoHash := tc.resolveInfoHashAlias(magnetKey(spec))
 
-	reader := file.NewReader()
-	defer reader.Close()
+	// 1. Check in-memory LRU cache
+	if t, found := tc.cachedTorrent(infoHash, trackers); found {
+		return t, nil
+	}
 
-	_, err = reader.Seek(start, io.SeekStart)
+	// Requests that miss the cache together share one add, so the torrent isn't
+	// added, persisted and cached twice before either finishes.
+	t, shared, err := tc.sharedAdd(infoHash, func() (*torrent.Torrent, error) {
+		return tc.addTorrent(spec, magnetLink, infoHash, dataDir, trackers)
+	})
 	if err != nil {
-		log.Printf("Error seeking in file: %v", err)
-		http.Error(w, "Error seeking in file", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-
-	// Manual streaming loop with a buffer and flushing
-	buf := make([]byte, 1024*512) // 512KB buffer
-	bytesWritten := int64(0)
-	for bytesWritten < contentLength {
-		bytesToRead := contentLength - bytesWritten
-		if int64(len(buf)) < bytesToRead {
-			bytesToRead = int64(len(buf))
+	if shared {
+		slog.Debug("Shared an in-flight torrent add", "infoHash", infoHash)
+		if len(trackers) > 0 {
+			t.AddTrackers([][]string{trackers})
 		}
+	}
+	return t, nil
+}
 
-		n, err := reader.Read(buf[:bytesToRead])
-		if n > 0 {
-			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
-				log.Printf("Client disconnected during stream: %v", writeErr)
-				return // Client probably closed the connection
-			}
-			w.(http.Flusher).Flush() // Force data to be sent
-			bytesWritten += int64(n)
-		}
-		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading from torrent stream: %v", err)
-			}
-			break
-		}
+// sharedAdd runs add for infoHash unless an add of it is already in flight, in
+// which case it waits for that add's result. shared reports whether the result
+// was shared with other callers.
+func (tc *TorrentClient) sharedAdd(infoHash string, add func() (*torrent.Torrent, error)) (t *torrent.Torrent, shared bool, err error) {
+	v, err, shared := tc.torrentAdds.Do(infoHash, func() (any, error) {
+		return add()
+	})
+	if err != nil {
+		return nil, shared, err
 	}
-	// --- END of Manual Range Request Handling ---
+	return v.(*torrent.Torrent), shared, nil
 }
 
-// ***************************************************************
-// ***                 END OF UPDATED FUNCTION                   ***
-// ***************************************************************
+// cachedTorrent returns the torrent cached under infoHash, marking it accessed
+// and adding trackers to it.
+func (tc *TorrentClient) cachedTorrent(infoHash string, trackers []string) (*torrent.Torrent, bool) {
+	val, found := tc.cache.Get(infoHash)
+	if !found {
+		return nil, false
+	}
+	slog.Debug("Using in-memory cached torrent", "infoHash", infoHash)
+	tc.cacheHits.Add(1)
+	entry := val.(*cacheEntry)
+	entry.mu.Lock()
+	entry.lastAccessed = time.Now()
+	entry.mu.Unlock()
+	if len(trackers) > 0 {
+		entry.torrent.AddTrackers([][]string{trackers})
+	}
+	return entry.torrent, true
+}
 
-// srtToVtt converts SRT format subtitles to VTT format.
-func srtToVtt(srt string) string {
-	log.Println("srtToVtt: Starting conversion.")
-	var vtt strings.Builder
-	vtt.WriteString("WEBVTT\n\n")
+// addTorrent is the cache-miss path of getTorrentFromMagnet: it adds the torrent
+// from persisted metadata or the swarm, persists its metainfo and caches it.
+func (tc *TorrentClient) addTorrent(spec metainfo.MagnetV2, magnetLink, infoHash, dataDir string, trackers []string) (*torrent.Torrent, error) {
+	// A request that missed the cache just before an earlier add finished
+	// starts a new flight; the torrent is cached by now.
+	if t, found := tc.cachedTorrent(infoHash, trackers); found {
+		return t, nil
+	}
+	// Registered before the torrent is added, so an info-only fetch that shares
+	// it doesn't drop it before it is cached.
+	tc.beginTorrentUse(infoHash)
+	defer tc.endTorrentUse(infoHash)
+	extraTrackers := appendUniqueTrackers(append([]string(nil), tc.extraTrackers...), trackers...)
 
-	// Normalize newlines and split into blocks
-	blocks := strings.Split(strings.ReplaceAll(srt, "\r\n", "\n"), "\n\n")
+	if err := tc.checkFreeSpace(dataDir); err != nil {
+		return nil, err
+	}
 
-	for _, block := range blocks {
-		trimmedBlock := strings.TrimSpace(block)
-		if trimmedBlock == "" {
-			continue
+	// 2. Check LotusDB for persisted metadata
+	metaBytes, err := tc.getMetainfo(infoHash)
+	if errors.Is(err, errMetainfoDecrypt) {
+		return nil, err
+	}
+	if err == nil {
+		slog.Debug("Found metadata in LotusDB", "infoHash", infoHash)
+		mi, err := metainfo.Load(bytes.NewReader(metaBytes))
+		if err != nil {
+			slog.Warn("Error loading metadata from LotusDB, falling back to magnet", "infoHash", infoHash, "err", err)
+		} else {
+			t, err := tc.addTorrentSpec(mi, dataDir)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add torrent from cached metadata: %w", err)
+			}
+			<-t.GotInfo() // Should be immediate
+			if len(extraTrackers) > 0 {
+				t.AddTrackers([][]string{extraTrackers})
+			}
+			slog.Info("Torrent info loaded from DB", "infoHash", infoHash, "name", t.Name(), "dataDir", dataDir)
+			tc.dbHits.Add(1)
+			tc.touchMetainfo(infoHash)
+			tc.torrentsAdded.Add(1)
+			entry := &cacheEntry{torrent: t, prevReadTime: time.Now(), lastAccessed: time.Now(), dataDir: dataDir, createdAt: metainfoCreatedAt(mi)}
+			tc.cache.Add(infoHash, entry)
+			tc.saveSession()
+			tc.verifyExistingData(entry)
+			return t, nil
 		}
+	}
 
-		lines := strings.Split(trimmedBlock, "\n")
+	// 3. Fetch from magnet link as a last resort
+	if len(extraTrackers) > 0 {
+		spec.Trackers = appendUniqueTrackers(spec.Trackers, extraTrackers...)
+		slog.Debug("Appended extra trackers to magnet link", "infoHash", infoHash, "count", len(extraTrackers))
+	}
+	slog.Info("Adding magnet link to client", "infoHash", infoHash, "magnet", magnetLink, "dataDir", dataDir)
+	tc.magnetFetches.Add(1)
+	tspec, err := torrent.TorrentSpecFromMagnetUri(spec.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet link: %w", err)
+	}
+	release, err := tc.acquireMetadataSlot(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	t, err := tc.addToClient(tspec, dataDir)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("failed to add magnet link: %w", err)
+	}
 
-		// Find the timestamp line
-		timeLineIndex := -1
-		for i, line := range lines {
-			if strings.Contains(line, "-->") {
-				timeLineIndex = i
-				break
-			}
+	err = tc.waitForInfo(t, infoHash)
+	release()
+	if err != nil {
+		tc.dropUnlessInUse(t, infoHash)
+		return nil, err
+	}
+	// A hybrid torrent requested by its v2 infohash is keyed by its v1 infohash
+	// once the info arrives, so it is never cached twice.
+	key := infoHash
+	if canonical := t.InfoHash().HexString(); canonical != infoHash {
+		tc.putInfoHashAlias(infoHash, canonical)
+		infoHash = canonical
+		if val, found := tc.cache.Get(infoHash); found {
+			// Already active under its v1 infohash: drop the copy added by v2.
+			tc.dropUnlessInUse(t, key)
+			return val.(*cacheEntry).torrent, nil
 		}
+	}
+	slog.Info("Torrent info received", "infoHash", infoHash, "name", t.Name())
+	tc.torrentsAdded.Add(1)
+	tc.persistMetainfo(t, infoHash)
+	entry := &cacheEntry{torrent: t, prevReadTime: time.Now(), lastAccessed: time.Now(), dataDir: dataDir, createdAt: time.Now()}
+	tc.cache.Add(infoHash, entry)
+	tc.saveSession()
+	tc.verifyExistingData(entry)
+	return t, nil
+}
 
-		if timeLineIndex != -1 {
-			// Write timestamp line (converted)
-			vtt.WriteString(strings.ReplaceAll(lines[timeLineIndex], ",", ".") + "\n")
-			// Write text lines
-			for i := timeLineIndex + 1; i < len(lines); i++ {
-				vtt.WriteString(lines[i] + "\n")
-			}
-			vtt.WriteString("\n")
+// errInsufficientStorage is returned when a torrent can't be added because the
+// download directory is low on free space.
+var errInsufficientStorage = errors.New("insufficient free space in the download directory")
+
+// torrentErrorStatus maps a getTorrentFromMagnet error to an HTTP status.
+func torrentErrorStatus(err error) int {
+	if errors.Is(err, errInsufficientStorage) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// checkFreeSpace returns errInsufficientStorage if the filesystem holding dataDir
+// has less free space than -min-free-space allows.
+func (tc *TorrentClient) checkFreeSpace(dataDir string) error {
+	if tc.minFreeBytes == 0 && tc.minFreePercent == 0 {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dataDir, &st); err != nil {
+		slog.Warn("Could not check free disk space", "path", dataDir, "err", err)
+		return nil
+	}
+	free := uint64(st.Bavail) * uint64(st.Bsize)
+	total := uint64(st.Blocks) * uint64(st.Bsize)
+	if free < tc.minFreeBytes || (total > 0 && float64(free)/float64(total)*100 < tc.minFreePercent) {
+		slog.Warn("Refusing to add torrent, download directory is low on space", "path", dataDir, "free", humanReadableSize(int64(free)), "total", humanReadableSize(int64(total)))
+		return fmt.Errorf("%w (%s free)", errInsufficientStorage, humanReadableSize(int64(free)))
+	}
+	return nil
+}
+
+// parseFreeSpace parses -min-free-space: a byte count, or a percentage of the
+// filesystem size such as "5%".
+func parseFreeSpace(value string) (minBytes uint64, percent float64, err error) {
+	value = strings.TrimSpace(value)
+	if p, ok := strings.CutSuffix(value, "%"); ok {
+		percent, err = strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return 0, 0, fmt.Errorf("invalid percentage %q", value)
 		}
+		return 0, percent, nil
 	}
-	log.Printf("srtToVtt: Converted VTT content length: %d", len(vtt.String()))
-	return vtt.String()
+	minBytes, err = strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("expected a byte count or a percentage like '5%%', got %q", value)
+	}
+	return minBytes, 0, nil
 }
 
-func (tc *TorrentClient) cleanupTorrentAssociatedFiles(infoHash string) {
-	tc.vttFileMapMu.Lock()
-	defer tc.vttFileMapMu.Unlock()
+// addTorrentSpec adds a torrent from metainfo with its data stored in dataDir.
+func (tc *TorrentClient) addTorrentSpec(mi *metainfo.MetaInfo, dataDir string) (*torrent.Torrent, error) {
+	tspec, err := torrent.TorrentSpecFromMetaInfoErr(mi)
+	if err != nil {
+		return nil, err
+	}
+	return tc.addToClient(tspec, dataDir)
+}
 
-	keysToDelete := []string{}
-	for key, filePath := range tc.vttFileMap {
-		if strings.HasPrefix(key, infoHash+"_") { // Assuming vttKey starts with infoHash
-			log.Printf("Deleting VTT file: %s", filePath)
-			if err := os.Remove(filePath); err != nil {
-				log.Printf("Error deleting VTT file %s: %v", filePath, err)
+// errTorrentDropped is returned when a torrent is dropped, e.g. by /cache/clear or
+// /purge, while a request is waiting for its info.
+var errTorrentDropped = errors.New("torrent was removed while waiting for its info")
+
+// waitForInfo waits for a magnet torrent's info, re-announcing while a timeout looks
+// transient. On failure the caller decides whether to drop the torrent, since an
+// add or info-only fetch sharing it may still be waiting.
+func (tc *TorrentClient) waitForInfo(t *torrent.Torrent, infoHash string) error {
+	slog.Debug("Waiting for torrent info", "infoHash", infoHash)
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-t.GotInfo():
+			select {
+			case <-t.Closed():
+				return errTorrentDropped
+			default:
+				return nil
 			}
-			keysToDelete = append(keysToDelete, key)
+		case <-t.Closed():
+			return errTorrentDropped
+		case <-tc.ctx.Done():
+			return tc.ctx.Err()
+		case <-time.After(tc.metadataTimeout):
+			if attempt < tc.metadataRetries && tc.isTransientInfoFailure(t) {
+				slog.Warn("No torrent info yet, likely a transient network issue; re-announcing and waiting again", "infoHash", infoHash, "retry", attempt+1, "maxRetries", tc.metadataRetries)
+				tc.reannounce(t)
+				continue
+			}
+			stats := t.Stats()
+			waitStatus := fmt.Sprintf("waited %v over %d attempt(s); %d known peer(s), %d connected, %d connecting",
+				time.Duration(attempt+1)*tc.metadataTimeout, attempt+1, len(t.KnownSwarm()), stats.ActivePeers, stats.HalfOpenPeers)
+			slog.Warn("Timeout waiting for torrent info", "infoHash", infoHash, "status", waitStatus)
+			return fmt.Errorf("timeout getting torrent info (%s)", waitStatus)
 		}
 	}
+}
 
-	for _, key := range keysToDelete {
-		delete(tc.vttFileMap, key)
+// beginTorrentUse registers an add or info-only fetch of infoHash that is about
+// to add the torrent to the client, and reports whether the torrent will be
+// created by it: it isn't in the client and nothing else is adding it. Call
+// endTorrentUse when done.
+func (tc *TorrentClient) beginTorrentUse(infoHash string) (created bool) {
+	tc.torrentUsesMu.Lock()
+	defer tc.torrentUsesMu.Unlock()
+	_, inClient := tc.client.Torrent(metainfo.NewHashFromHex(infoHash))
+	created = !inClient && tc.torrentUses[infoHash] == 0
+	tc.torrentUses[infoHash]++
+	return created
+}
+
+// endTorrentUse ends a use registered with beginTorrentUse.
+func (tc *TorrentClient) endTorrentUse(infoHash string) {
+	tc.torrentUsesMu.Lock()
+	defer tc.torrentUsesMu.Unlock()
+	if tc.torrentUses[infoHash]--; tc.torrentUses[infoHash] <= 0 {
+		delete(tc.torrentUses, infoHash)
 	}
+}
 
-	// --- New ASS and Log file cleanup ---
-	patterns := []string{
-		filepath.Join(tc.downloadDir, fmt.Sprintf("%s_*.ass", infoHash)),
-		filepath.Join(tc.downloadDir, fmt.Sprintf("%s_*.log", infoHash)),
+// torrentInUseLocked reports whether an add or info-only fetch holds a use of t.
+// A torrent added by its v2 infohash is keyed by the full v2 hash, which starts
+// with the truncated hash the client reports. torrentUsesMu must be held.
+func (tc *TorrentClient) torrentInUseLocked(t *torrent.Torrent) bool {
+	hash := t.InfoHash().HexString()
+	for key := range tc.torrentUses {
+		if strings.HasPrefix(key, hash) {
+			return true
+		}
 	}
+	return false
+}
 
-	for _, pattern := range patterns {
-		matches, err := filepath.Glob(pattern)
-		if err != nil {
-			log.Printf("Error globbing files for pattern %s: %v", pattern, err)
-			continue
+// dropUnlessInUse drops t, which the caller added under infoHash and still holds
+// a use of, unless another add or info-only fetch of it is in flight or it has
+// been cached meanwhile. The check and drop happen under torrentUsesMu, so an add
+// starting concurrently either keeps the torrent alive or adds a fresh one.
+func (tc *TorrentClient) dropUnlessInUse(t *torrent.Torrent, infoHash string) bool {
+	tc.torrentUsesMu.Lock()
+	defer tc.torrentUsesMu.Unlock()
+	if tc.torrentUses[infoHash] > 1 {
+		return false
+	}
+	for _, key := range []string{infoHash, t.InfoHash().HexString()} {
+		if val, found := tc.cache.Peek(key); found && val.(*cacheEntry).torrent == t {
+			return false
 		}
-		for _, file := range matches {
-			log.Printf("Deleting associated file: %s", file)
-			if err := os.Remove(file); err != nil {
-				log.Printf("Error deleting associated file %s: %v", file, err)
+	}
+	t.Drop()
+	return true
+}
+
+// Retry schedule for metainfo writes that fail, e.g. while LotusDB is busy.
+const (
+	persistRetries      = 4
+	persistRetryBackoff = 250 * time.Millisecond // Doubled after every attempt
+)
+
+// persistMetainfo saves a torrent's metainfo to LotusDB so later lookups skip the swarm.
+// If the first write fails it is retried in the background with exponential
+// backoff, so the caller (usually a stream) is never held up.
+func (tc *TorrentClient) persistMetainfo(t *torrent.Torrent, infoHash string) {
+	if tc.db == nil {
+		return
+	}
+	var buf bytes.Buffer
+	mi := t.Metainfo()
+	if err := mi.Write(&buf); err != nil {
+		slog.Error("Error writing metainfo to buffer", "infoHash", infoHash, "err", err)
+		return
+	}
+	err := tc.putMetainfo(infoHash, buf.Bytes())
+	if err == nil {
+		tc.metainfoPersisted(t, infoHash, mi.InfoBytes)
+		return
+	}
+	slog.Warn("Error saving metainfo to LotusDB, retrying", "infoHash", infoHash, "err", err)
+	go func() {
+		backoff := persistRetryBackoff
+		for attempt := 1; attempt <= persistRetries; attempt++ {
+			select {
+			case <-tc.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			if err = tc.putMetainfo(infoHash, buf.Bytes()); err == nil {
+				tc.metainfoPersisted(t, infoHash, mi.InfoBytes)
+				return
 			}
+			slog.Warn("Error saving metainfo to LotusDB", "infoHash", infoHash, "attempt", attempt, "maxRetries", persistRetries, "err", err)
+			backoff *= 2
 		}
+		slog.Error("Giving up saving metainfo to LotusDB; the torrent will be fetched from the swarm again", "infoHash", infoHash, "err", err)
+		tc.persistFailures.Add(1)
+		metricPersistFailures.Inc()
+	}()
+}
+
+// openMetadataDB opens the LotusDB database holding persisted metadata under
+// downloadDir, removing a stale lock left by a crashed process if needed.
+func openMetadataDB(downloadDir string) (*lotusdb.DB, error) {
+	dbPath := filepath.Join(downloadDir, "lotusdb_meta")
+	if err := os.MkdirAll(dbPath, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lotusdb directory: %w", err)
 	}
-	// --- End New ASS and Log file cleanup ---
+	dbOpts := lotusdb.DefaultOptions
+	dbOpts.DirPath = dbPath
+	var db *lotusdb.DB
+	var err error
+	for i := 0; i < 5; i++ {
+		db, err = lotusdb.Open(dbOpts)
+		if err == nil {
+			break
+		}
+		slog.Warn("Failed to open lotusdb, retrying", "attempt", i+1, "maxAttempts", 5, "err", err)
+		if strings.Contains(err.Error(), "the database directory is used by another process") {
+			lockFilePath := filepath.Join(dbOpts.DirPath, "FLOCK")
+			slog.Warn("Database is locked, attempting to remove lock file", "path", lockFilePath)
+			if removeErr := os.Remove(lockFilePath); removeErr != nil {
+				slog.Error("Failed to remove lock file", "path", lockFilePath, "err", removeErr)
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lotusdb after 5 retries: %w", err)
+	}
+	return db, nil
 }
 
-func (tc *TorrentClient) downloadSubtitleHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("downloadSubtitleHandler: Received request for magnet: %s, filePath: %s", r.URL.Query().Get("url"), r.URL.Query().Get("filePath"))
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+// encryptedMetaPrefix marks a LotusDB metainfo value as "nonce || AES-GCM
+// ciphertext". Values without it are plaintext, as written without a key.
+const encryptedMetaPrefix = "enc1:"
+
+// errMetainfoDecrypt is returned for persisted metainfo that can't be decrypted.
+// It is not a cache miss: falling back to the swarm would hide a wrong key.
+var errMetainfoDecrypt = errors.New("cannot decrypt persisted metadata; check -db-encryption-key")
+
+// putMetainfo stores a torrent's metainfo under its infohash, encrypted when
+// -db-encryption-key is set. The infohash is the associated data, so a value
+// copied to another key fails to decrypt.
+func (tc *TorrentClient) putMetainfo(infoHash string, data []byte) error {
+	if tc.metaCipher != nil {
+		nonce := make([]byte, tc.metaCipher.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		sealed := tc.metaCipher.Seal(nonce, nonce, data, []byte(infoHash))
+		data = append([]byte(encryptedMetaPrefix), sealed...)
+	}
+	return tc.db.Put([]byte(infoHash), data)
+}
+
+// getMetainfo loads metainfo stored by putMetainfo, decrypting it if needed.
+// Plaintext values written before a key was configured are still readable.
+func (tc *TorrentClient) getMetainfo(infoHash string) ([]byte, error) {
+	if tc.db == nil {
+		return nil, lotusdb.ErrKeyNotFound
+	}
+	data, err := tc.db.Get([]byte(infoHash))
+	if err != nil {
+		return nil, err
+	}
+	sealed, encrypted := bytes.CutPrefix(data, []byte(encryptedMetaPrefix))
+	if !encrypted {
+		return data, nil
+	}
+	if tc.metaCipher == nil {
+		return nil, fmt.Errorf("%w: metadata for %s is encrypted but no key is set", errMetainfoDecrypt, infoHash)
+	}
+	nonceSize := tc.metaCipher.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("%w: metadata for %s is truncated", errMetainfoDecrypt, infoHash)
+	}
+	plain, err := tc.metaCipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(infoHash))
+	if err != nil {
+		return nil, fmt.Errorf("%w: metadata for %s", errMetainfoDecrypt, infoHash)
+	}
+	return plain, nil
+}
+
+// deleteMetainfo removes a torrent's persisted metainfo.
+func (tc *TorrentClient) deleteMetainfo(infoHash string) {
+	if tc.db == nil {
 		return
 	}
+	if err := tc.db.Delete([]byte(infoHash)); err != nil {
+		slog.Error("Failed to delete torrent metadata from LotusDB", "infoHash", infoHash, "err", err)
+	}
+	if err := tc.db.Delete([]byte(accessKeyPrefix + infoHash)); err != nil {
+		slog.Error("Failed to delete metadata access time from LotusDB", "infoHash", infoHash, "err", err)
+	}
+}
 
-	filePath := r.URL.Query().Get("filePath")
-	if filePath == "" {
-		http.Error(w, "Missing 'filePath' query parameter", http.StatusBadRequest)
+// touchMetainfo records that a torrent's persisted metainfo was just used, so
+// -metadata-ttl counts from now.
+func (tc *TorrentClient) touchMetainfo(infoHash string) {
+	if tc.db == nil {
 		return
 	}
+	if err := tc.db.Put([]byte(accessKeyPrefix+infoHash), []byte(strconv.FormatInt(time.Now().Unix(), 10))); err != nil {
+		slog.Warn("Failed to save metadata access time to LotusDB", "infoHash", infoHash, "err", err)
+	}
+}
 
-	spec, err := metainfo.ParseMagnetURI(magnetLink)
+// expireMetadata deletes the persisted metainfo, and the aliases pointing to it,
+// of torrents whose metainfo hasn't been used for longer than -metadata-ttl.
+// Torrents in the LRU cache are kept. Metainfo saved before access times were
+// recorded is treated as used now.
+func (tc *TorrentClient) expireMetadata() {
+	if tc.db == nil {
+		return
+	}
+	iter, err := tc.db.NewIterator(lotusdb.IteratorOptions{})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid magnet link: %v", err), http.StatusBadRequest)
+		slog.Error("Error iterating LotusDB", "err", err)
 		return
 	}
-	infoHash := spec.InfoHash.HexString()
+	var infoHashes []string
+	accessed := make(map[string]time.Time)
+	aliases := make(map[string]string) // Alias key -> infohash
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		switch {
+		case infoHashKeyPattern.MatchString(key):
+			infoHashes = append(infoHashes, key)
+		case strings.HasPrefix(key, accessKeyPrefix):
+			if sec, err := strconv.ParseInt(string(iter.Value()), 10, 64); err == nil {
+				accessed[strings.TrimPrefix(key, accessKeyPrefix)] = time.Unix(sec, 0)
+			}
+		case strings.HasPrefix(key, aliasKeyPrefix):
+			aliases[key] = string(iter.Value())
+		}
+	}
+	if err := iter.Close(); err != nil {
+		slog.Error("Error closing LotusDB iterator", "err", err)
+	}
+
+	expired := make(map[string]bool)
+	for _, infoHash := range infoHashes {
+		if tc.cache.Contains(infoHash) {
+			continue
+		}
+		last, ok := accessed[infoHash]
+		if !ok {
+			tc.touchMetainfo(infoHash)
+			continue
+		}
+		if time.Since(last) > tc.metadataTTL {
+			slog.Debug("Expiring persisted metadata", "infoHash", infoHash, "lastUsed", last)
+			tc.deleteMetainfo(infoHash)
+			expired[infoHash] = true
+		}
+	}
+	for key, infoHash := range aliases {
+		if expired[infoHash] {
+			if err := tc.db.Delete([]byte(key)); err != nil {
+				slog.Error("Error deleting infohash alias from LotusDB", "alias", strings.TrimPrefix(key, aliasKeyPrefix), "err", err)
+			}
+		}
+	}
+	if len(expired) > 0 {
+		slog.Info("Expired persisted metadata", "torrents", len(expired), "kept", len(infoHashes)-len(expired), "ttl", tc.metadataTTL)
+	}
+}
+
+// metainfoPersisted finishes a successful persistMetainfo.
+func (tc *TorrentClient) metainfoPersisted(t *torrent.Torrent, infoHash string, infoBytes []byte) {
+	slog.Debug("Saved metadata to LotusDB", "infoHash", infoHash)
+	tc.touchMetainfo(infoHash)
+	// Let a later v2-only magnet of a hybrid torrent find this metadata.
+	if info := t.Info(); info != nil && info.HasV1() && info.HasV2() {
+		v2 := infohash_v2.HashBytes(infoBytes)
+		tc.putInfoHashAlias(v2.ToShort().HexString(), infoHash)
+	}
+}
+
+// magnetKey returns the identifier a magnet's torrent is keyed by in the cache and
+// LotusDB: the hex v1 infohash, or for v2-only magnets the truncated v2 infohash,
+// matching Torrent.InfoHash.
+func magnetKey(m metainfo.MagnetV2) string {
+	if m.InfoHash.Ok {
+		return m.InfoHash.Value.HexString()
+	}
+	return m.V2InfoHash.Value.ToShort().HexString()
+}
 
-	t, err := tc.getTorrentFromMagnet(magnetLink)
+// infoHashKey parses a magnet link and returns the key of its torrent, following
+// aliases so a hybrid torrent is found by either infohash.
+func (tc *TorrentClient) infoHashKey(magnetLink string) (string, error) {
+	m, err := metainfo.ParseMagnetV2Uri(magnetLink)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", fmt.Errorf("invalid magnet link: %v", err)
+	}
+	return tc.resolveInfoHashAlias(magnetKey(m)), nil
+}
+
+// putInfoHashAlias records that the torrent keyed by alias is stored under key.
+func (tc *TorrentClient) putInfoHashAlias(alias, key string) {
+	if tc.db == nil {
 		return
 	}
+	if err := tc.db.Put([]byte(aliasKeyPrefix+alias), []byte(key)); err != nil {
+		slog.Error("Error saving infohash alias to LotusDB", "alias", alias, "infoHash", key, "err", err)
+	}
+}
 
-	var targetFile *torrent.File
-	for _, file := range t.Files() {
-		if file.DisplayPath() == filePath {
-			targetFile = file
-			break
+// resolveInfoHashAlias returns the key a hybrid torrent's v2 infohash maps to, or
+// key itself when there is no alias.
+func (tc *TorrentClient) resolveInfoHashAlias(key string) string {
+	if tc.db == nil {
+		return key
+	}
+	if canonical, err := tc.db.Get([]byte(aliasKeyPrefix + key)); err == nil {
+		return string(canonical)
+	}
+	return key
+}
+
+// metainfoCreatedAt returns the creation date of metainfo, which persistMetainfo
+// sets to the time the metadata was first saved.
+func metainfoCreatedAt(mi *metainfo.MetaInfo) time.Time {
+	if mi.CreationDate > 0 {
+		return time.Unix(mi.CreationDate, 0)
+	}
+	return time.Now()
+}
+
+// loadInfo decodes the info dictionary of persisted metainfo bytes.
+func loadInfo(metaBytes []byte) (*metainfo.Info, error) {
+	mi, err := metainfo.Load(bytes.NewReader(metaBytes))
+	if err != nil {
+		return nil, err
+	}
+	info, err := mi.UnmarshalInfo()
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// getTorrentInfo returns a torrent's info for browsing without keeping it active.
+// Unlike getTorrentFromMagnet it never adds the torrent to the LRU cache, so
+// listing files can't evict a torrent that is being streamed. A torrent fetched
+// from the swarm only for its info is dropped once the info is persisted.
+func (tc *TorrentClient) getTorrentInfo(magnetLink, dataDir string, trackers ...string) (*metainfo.Info, string, error) {
+	spec, err := metainfo.ParseMagnetV2Uri(magnetLink)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid magnet link: %w", err)
+	}
+	infoHash := tc.resolveInfoHashAlias(magnetKey(spec))
+
+	// 1. An active torrent already has its info.
+	if val, found := tc.cache.Peek(infoHash); found {
+		if info := val.(*cacheEntry).torrent.Info(); info != nil {
+			slog.Debug("Using in-memory cached torrent info", "infoHash", infoHash)
+			tc.cacheHits.Add(1)
+			return info, infoHash, nil
 		}
 	}
 
-	if targetFile == nil {
-		http.Error(w, "Subtitle file not found in torrent", http.StatusNotFound)
-		return
+	// 2. Persisted metadata.
+	metaBytes, err := tc.getMetainfo(infoHash)
+	if errors.Is(err, errMetainfoDecrypt) {
+		return nil, "", err
+	}
+	if err == nil {
+		info, err := loadInfo(metaBytes)
+		if err == nil {
+			slog.Debug("Using torrent info from LotusDB", "infoHash", infoHash)
+			tc.dbHits.Add(1)
+			tc.touchMetainfo(infoHash)
+			return info, infoHash, nil
+		}
+		slog.Warn("Error loading metadata from LotusDB, falling back to magnet", "infoHash", infoHash, "err", err)
 	}
 
-	reader := targetFile.NewReader()
-	defer reader.Close()
+	// 3. Fetch the info from the swarm. Simultaneous requests for the same
+	// torrent share one fetch.
+	type fetched struct {
+		info     *metainfo.Info
+		infoHash string
+	}
+	v, err, shared := tc.infoFetches.Do(infoHash, func() (any, error) {
+		info, canonical, err := tc.fetchTorrentInfo(spec, infoHash, dataDir, trackers)
+		return fetched{info, canonical}, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if shared {
+		slog.Debug("Shared an in-flight torrent info fetch", "infoHash", infoHash)
+	}
+	f := v.(fetched)
+	return f.info, f.infoHash, nil
+}
 
-	srtBytes, err := io.ReadAll(reader)
+// fetchTorrentInfo fetches a torrent's info from the swarm for getTorrentInfo and
+// returns it with the torrent's canonical infohash. The torrent is added with
+// dataDir's storage, since a stream starting meanwhile shares it. If the client
+// already had the torrent, or an add is waiting on it, it is left running;
+// otherwise it is dropped once the info is persisted.
+func (tc *TorrentClient) fetchTorrentInfo(spec metainfo.MagnetV2, infoHash, dataDir string, trackers []string) (*metainfo.Info, string, error) {
+	release, err := tc.acquireMetadataSlot(infoHash)
 	if err != nil {
-		http.Error(w, "Failed to read subtitle file", http.StatusInternalServerError)
-		return
+		return nil, "", err
+	}
+	defer release()
+	extraTrackers := appendUniqueTrackers(append([]string(nil), tc.extraTrackers...), trackers...)
+	spec.Trackers = appendUniqueTrackers(spec.Trackers, extraTrackers...)
+	spec.DisplayName = sanitize(spec.DisplayName)
+	tspec, err := torrent.TorrentSpecFromMagnetUri(spec.String())
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid magnet link: %w", err)
+	}
+	slog.Info("Fetching torrent info only", "infoHash", infoHash)
+	tc.magnetFetches.Add(1)
+	created := tc.beginTorrentUse(infoHash)
+	defer tc.endTorrentUse(infoHash)
+	t, err := tc.addToClient(tspec, dataDir)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to add magnet link: %w", err)
+	}
+	if err := tc.waitForInfo(t, infoHash); err != nil {
+		tc.dropUnlessInUse(t, infoHash)
+		return nil, "", err
+	}
+	key := infoHash
+	if canonical := t.InfoHash().HexString(); canonical != infoHash {
+		tc.putInfoHashAlias(infoHash, canonical)
+		infoHash = canonical
+	}
+	tc.persistMetainfo(t, infoHash)
+	info := t.Info()
+	if created {
+		tc.dropUnlessInUse(t, key)
 	}
+	return info, infoHash, nil
+}
 
-	vttContent := srtToVtt(string(srtBytes))
+// acquireMetadataSlot waits until fewer than -max-concurrent-metadata torrents
+// are fetching their info from the swarm, so a burst of new magnets doesn't
+// flood the DHT and connection limits. Call release when the fetch is done.
+func (tc *TorrentClient) acquireMetadataSlot(infoHash string) (release func(), err error) {
+	if tc.metadataSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case tc.metadataSlots <- struct{}{}:
+	default:
+		slog.Info("Waiting for a metadata fetch slot", "infoHash", infoHash, "limit", cap(tc.metadataSlots))
+		select {
+		case tc.metadataSlots <- struct{}{}:
+		case <-tc.ctx.Done():
+			return nil, tc.ctx.Err()
+		}
+	}
+	return func() { <-tc.metadataSlots }, nil
+}
 
-	// Construct a deterministic VTT filename: infoHash_filePathHash.vtt
-	// Use a hash of infoHash and filePath to ensure uniqueness and consistency
-	uniqueKey := infoHash + filePath
-	hash := sha256.Sum256([]byte(uniqueKey))
-	vttFilename := fmt.Sprintf("%s_%s.vtt", infoHash, hex.EncodeToString(hash[:]))
-	vttFilePath := filepath.Join(tc.downloadDir, vttFilename)
+// isTransientInfoFailure reports whether a metadata timeout looks like a network
+// blip worth retrying rather than a dead torrent. Known peers mean the metadata may
+// still arrive; a DHT with no reachable nodes means we couldn't look for peers at
+// all. A healthy DHT that found no peers points to a genuinely dead torrent.
+func (tc *TorrentClient) isTransientInfoFailure(t *torrent.Torrent) bool {
+	if len(t.KnownSwarm()) > 0 {
+		return true
+	}
+	dhtServers := tc.client.DhtServers()
+	if len(dhtServers) == 0 {
+		return true
+	}
+	for _, s := range dhtServers {
+		if stats, ok := s.Stats().(dht.ServerStats); ok && stats.GoodNodes > 0 {
+			return false
+		}
+	}
+	return true
+}
 
-	// Check if this VTT file already exists and is valid
-	if _, err := os.Stat(vttFilePath); err == nil {
-		log.Printf("downloadSubtitleHandler: Found existing VTT file at %s. Adding to vttFileMap.", vttFilePath)
-		// File exists, assume it's valid and return its key
-		tc.vttFileMapMu.Lock()
-		tc.vttFileMap[vttFilename] = vttFilePath
-		tc.vttFileMapMu.Unlock()
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"vttKey": vttFilename})
+// reannounce asks the DHT for peers again. Trackers are re-announced by the client
+// on its own schedule.
+func (tc *TorrentClient) reannounce(t *torrent.Torrent) {
+	for _, s := range tc.client.DhtServers() {
+		done, stop, err := t.AnnounceToDht(s)
+		if err != nil {
+			slog.Warn("Error re-announcing to DHT", "infoHash", t.InfoHash().HexString(), "err", err)
+			continue
+		}
+		go func() {
+			select {
+			case <-done:
+			case <-time.After(time.Minute):
+				stop()
+			}
+		}()
+	}
+}
+
+// appendUniqueTrackers appends the trackers not already present in list.
+func appendUniqueTrackers(list []string, trackers ...string) []string {
+	seen := make(map[string]bool, len(list))
+	for _, tr := range list {
+		seen[tr] = true
+	}
+	for _, tr := range trackers {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			list = append(list, tr)
+		}
+	}
+	return list
+}
+
+// parseTrackerList parses the -extra-trackers flag: either a path to a file with
+// one announce URL per line (blank lines and # comments are ignored) or a
+// comma-separated list of URLs.
+func parseTrackerList(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, nil
+	}
+	separator := ","
+	if info, err := os.Stat(value); err == nil && !info.IsDir() {
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tracker list %s: %w", value, err)
+		}
+		value, separator = string(data), "\n"
+	}
+	var trackers []string
+	for _, tr := range strings.Split(value, separator) {
+		tr = strings.TrimSpace(tr)
+		if tr == "" || strings.HasPrefix(tr, "#") {
+			continue
+		}
+		trackers = appendUniqueTrackers(trackers, tr)
+	}
+	return trackers, nil
+}
+
+// requestTrackers returns the announce URLs passed in the comma-separated
+// 'trackers' query parameter.
+func requestTrackers(r *http.Request) []string {
+	var trackers []string
+	for _, tr := range strings.Split(r.URL.Query().Get("trackers"), ",") {
+		trackers = appendUniqueTrackers(trackers, strings.TrimSpace(tr))
+	}
+	return trackers
+}
+
+// maxRequestPeers caps the addresses accepted in one 'peers' query parameter.
+const maxRequestPeers = 50
+
+// requestPeers parses the optional 'peers' query parameter: comma-separated
+// ip:port addresses ([ip]:port for IPv6) of peers known to have the torrent,
+// such as a friend's seedbox.
+func requestPeers(r *http.Request) ([]torrent.PeerInfo, error) {
+	var peers []torrent.PeerInfo
+	for _, s := range strings.Split(r.URL.Query().Get("peers"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		addr, err := netip.ParseAddrPort(s)
+		if err != nil || addr.Port() == 0 {
+			return nil, fmt.Errorf("invalid peer address %q: expected ip:port", s)
+		}
+		peers = append(peers, torrent.PeerInfo{Addr: addr, Source: torrent.PeerSourceDirect})
+	}
+	if len(peers) > maxRequestPeers {
+		return nil, fmt.Errorf("too many peers: at most %d are accepted", maxRequestPeers)
+	}
+	return peers, nil
+}
+
+// addRequestPeers hands the peers from requestPeers to t.
+func addRequestPeers(t *torrent.Torrent, peers []torrent.PeerInfo) {
+	if len(peers) == 0 {
+		return
+	}
+	added := t.AddPeers(peers)
+	slog.Info("Added peers from request", "infoHash", t.InfoHash().HexString(), "requested", len(peers), "added", added)
+}
+
+// hasCompleteDataOnDisk reports whether every file of the torrent exists in
+// dataDir with its full length.
+func hasCompleteDataOnDisk(t *torrent.Torrent, dataDir string) bool {
+	for _, file := range t.Files() {
+		info, err := os.Stat(filepath.Join(dataDir, filepath.FromSlash(file.Path())))
+		if err != nil || info.Size() != file.Length() {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDataOnDisk reports whether any file of the torrent, complete or partial, has
+// data in dataDir.
+func hasDataOnDisk(t *torrent.Torrent, dataDir string) bool {
+	for _, file := range t.Files() {
+		path := filepath.Join(dataDir, filepath.FromSlash(file.Path()))
+		for _, candidate := range []string{path, path + ".part"} {
+			if info, err := os.Stat(candidate); err == nil && info.Size() > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyExistingData re-hashes a re-added torrent whose data is already on disk.
+// With -verify-on-readd, fully present data is checked so that statusHandler
+// reports verified completion instead of 0% until pieces happen to be checked.
+// With -verify-on-load, any data on disk is checked, even if the piece completion
+// store already considers it complete. Verification runs in the background and
+// its progress is reported by statusHandler.
+func (tc *TorrentClient) verifyExistingData(entry *cacheEntry) {
+	t := entry.torrent
+	switch {
+	case tc.verifyOnLoad && hasDataOnDisk(t, entry.dataDir):
+	case tc.verifyOnReadd && t.BytesCompleted() != t.Length() && hasCompleteDataOnDisk(t, entry.dataDir):
+	default:
+		return
+	}
+	entry.mu.Lock()
+	if entry.verifying {
+		entry.mu.Unlock()
+		return
+	}
+	entry.verifying = true
+	entry.verifiedPieces = 0
+	entry.mu.Unlock()
+
+	go func() {
+		slog.Info("Data is already on disk, verifying pieces", "infoHash", t.InfoHash().HexString(), "name", t.Name())
+		start := time.Now()
+		var err error
+		for i := 0; i < t.NumPieces() && err == nil; i++ {
+			if err = t.Piece(i).VerifyDataContext(tc.ctx); err != nil {
+				err = fmt.Errorf("verifying piece %d: %w", i, err)
+			}
+			entry.mu.Lock()
+			entry.verifiedPieces = i + 1
+			entry.mu.Unlock()
+		}
+		if err != nil {
+			slog.Error("Error verifying data", "infoHash", t.InfoHash().HexString(), "name", t.Name(), "err", err)
+		} else {
+			slog.Info("Verified existing data", "infoHash", t.InfoHash().HexString(), "name", t.Name(), "took", time.Since(start).Round(time.Millisecond),
+				"completed", humanReadableSize(t.BytesCompleted()), "total", humanReadableSize(t.Length()))
+		}
+		entry.mu.Lock()
+		entry.verifying = false
+		entry.mu.Unlock()
+	}()
+}
+
+// --- Session Persistence ---
+
+// saveSession stores the infohashes currently in the LRU cache (oldest first)
+// so they can be restored after a restart. It is a no-op unless -restore-session is set.
+func (tc *TorrentClient) saveSession() {
+	if !tc.restoreSessionEnabled || tc.db == nil {
+		return
+	}
+	infoHashes := []string{}
+	for _, key := range tc.cache.Keys() {
+		if infoHash, ok := key.(string); ok {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	data, err := json.Marshal(infoHashes)
+	if err != nil {
+		slog.Error("Error encoding session", "err", err)
+		return
+	}
+	if err := tc.db.Put([]byte(sessionKey), data); err != nil {
+		slog.Error("Error saving session to LotusDB", "err", err)
+	}
+}
+
+// restoreSession re-adds the torrents recorded by saveSession from their persisted
+// metainfo, up to the cache capacity.
+func (tc *TorrentClient) restoreSession() {
+	if tc.db == nil {
+		slog.Warn("Cannot restore the previous session with metadata persistence disabled")
+		return
+	}
+	data, err := tc.db.Get([]byte(sessionKey))
+	if err != nil {
+		if !errors.Is(err, lotusdb.ErrKeyNotFound) {
+			slog.Error("Error reading session from LotusDB", "err", err)
+		}
+		return
+	}
+	var infoHashes []string
+	if err := json.Unmarshal(data, &infoHashes); err != nil {
+		slog.Error("Error decoding session", "err", err)
+		return
+	}
+	if len(infoHashes) > lruCacheSize {
+		infoHashes = infoHashes[len(infoHashes)-lruCacheSize:]
+	}
+
+	slog.Info("Restoring torrents from the previous session", "count", len(infoHashes))
+	for _, infoHash := range infoHashes {
+		metaBytes, err := tc.getMetainfo(infoHash)
+		if err != nil {
+			slog.Warn("No persisted metadata for session torrent, skipping", "infoHash", infoHash, "err", err)
+			continue
+		}
+		mi, err := metainfo.Load(bytes.NewReader(metaBytes))
+		if err != nil {
+			slog.Error("Error loading metadata for session torrent", "infoHash", infoHash, "err", err)
+			continue
+		}
+		t, err := tc.client.AddTorrent(mi)
+		if err != nil {
+			slog.Error("Failed to restore torrent", "infoHash", infoHash, "err", err)
+			continue
+		}
+		<-t.GotInfo() // Immediate, the info comes from the metainfo
+		entry := &cacheEntry{torrent: t, prevReadTime: time.Now(), lastAccessed: time.Now(), dataDir: tc.downloadDir, createdAt: metainfoCreatedAt(mi)}
+		tc.cache.Add(infoHash, entry)
+		tc.verifyExistingData(entry)
+		tc.torrentsAdded.Add(1)
+		slog.Info("Restored torrent from previous session", "infoHash", infoHash, "name", t.Name())
+	}
+}
+
+// --- VTT Mapping Persistence ---
+
+// registerVttFile records the path of a converted VTT file both in memory and in
+// LotusDB, so the key handed to the frontend stays valid across restarts.
+func (tc *TorrentClient) registerVttFile(key, path string) {
+	tc.vttFileMapMu.Lock()
+	tc.vttFileMap[key] = path
+	tc.vttFileMapMu.Unlock()
+	if tc.db == nil {
+		return
+	}
+	if err := tc.db.Put([]byte(vttKeyPrefix+key), []byte(path)); err != nil {
+		slog.Error("Error persisting VTT mapping", "key", key, "err", err)
+	}
+}
+
+// loadVttFileMap repopulates vttFileMap from LotusDB, dropping entries whose
+// VTT file no longer exists on disk.
+func (tc *TorrentClient) loadVttFileMap() {
+	if tc.db == nil {
+		return
+	}
+	iter, err := tc.db.NewIterator(lotusdb.IteratorOptions{Prefix: []byte(vttKeyPrefix)})
+	if err != nil {
+		slog.Error("Error iterating VTT mappings", "err", err)
+		return
+	}
+	stale := [][]byte{}
+	tc.vttFileMapMu.Lock()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := strings.TrimPrefix(string(iter.Key()), vttKeyPrefix)
+		path := string(iter.Value())
+		if _, err := os.Stat(path); err != nil {
+			stale = append(stale, append([]byte(nil), iter.Key()...))
+			continue
+		}
+		tc.vttFileMap[key] = path
+	}
+	loaded := len(tc.vttFileMap)
+	tc.vttFileMapMu.Unlock()
+	if err := iter.Close(); err != nil {
+		slog.Error("Error closing VTT mapping iterator", "err", err)
+	}
+
+	for _, key := range stale {
+		if err := tc.db.Delete(key); err != nil {
+			slog.Error("Error deleting stale VTT mapping", "key", string(key), "err", err)
+		}
+	}
+	slog.Info("Loaded VTT mappings from LotusDB", "loaded", loaded, "stale", len(stale))
+}
+
+func humanReadableSize(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+func humanReadableSpeed(bytesPerSecond float64) string {
+	return humanReadableSize(int64(bytesPerSecond)) + "/s"
+}
+
+// errNoFiles is reported for torrents whose info lists no files.
+var errNoFiles = errors.New("torrent contains no files")
+
+// infoFileCount returns the number of files a torrent's info lists. The library
+// upverts an empty "files" list to a single nameless file of length 0, which
+// isn't counted.
+func infoFileCount(info *metainfo.Info) int {
+	if !info.HasV2() && info.Files != nil && len(info.Files) == 0 {
+		return 0
+	}
+	return len(info.UpvertedFiles())
+}
+
+// requireFiles writes a 422 response and returns false if a torrent has no files.
+// Handlers call it once the torrent's info is available.
+func requireFiles(w http.ResponseWriter, info *metainfo.Info) bool {
+	if infoFileCount(info) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, errNoFiles.Error())
+		return false
+	}
+	return true
+}
+
+// getFileToStream returns the file at index, or the torrent's default file
+// (chosen by -default-file-strategy) if index is out of range.
+func (tc *TorrentClient) getFileToStream(t *torrent.Torrent, index int) *torrent.File {
+	files := t.Files()
+	if index >= 0 && index < len(files) {
+		return files[index]
+	}
+	switch tc.defaultFileStrategy {
+	case FileStrategyFirstVideo:
+		for _, file := range files {
+			if isVideoFile(file.DisplayPath()) {
+				return file
+			}
+		}
+		// No video files: fall back to the largest file.
+	case FileStrategyAlphabetical:
+		var first *torrent.File
+		for _, file := range files {
+			if first == nil || file.DisplayPath() < first.DisplayPath() {
+				first = file
+			}
+		}
+		return first
+	}
+	var largestFile *torrent.File
+	largestSize := int64(-1) // so a torrent of empty files still yields one
+	for _, file := range files {
+		if file.Length() > largestSize {
+			largestFile = file
+			largestSize = file.Length()
+		}
+	}
+	return largestFile
+}
+
+// errFileNotFound is returned when a request names a file the torrent doesn't
+// contain.
+var errFileNotFound = errors.New("file not found in torrent")
+
+// requestedFile returns the file a request selects and its index: the file whose
+// display path equals the 'path' query parameter, else the file at 'index', else
+// the default file (see getFileToStream). Paths stay valid when file order differs between metadata
+// sources; indexes are kept for compatibility. An unknown path or out-of-range
+// index yields errFileNotFound; a malformed index yields a plain error.
+func (tc *TorrentClient) requestedFile(t *torrent.Torrent, r *http.Request) (*torrent.File, int, error) {
+	if path := r.URL.Query().Get("path"); path != "" {
+		for i, file := range t.Files() {
+			if file.DisplayPath() == path {
+				return file, i, nil
+			}
+		}
+		return nil, -1, fmt.Errorf("%w: no file has the path %q", errFileNotFound, path)
+	}
+	indexStr := r.URL.Query().Get("index")
+	if indexStr == "" {
+		file := tc.getFileToStream(t, -1)
+		return file, fileIndex(t, file), nil
+	}
+	index, err := strconv.Atoi(indexStr)
+	if err != nil {
+		return nil, -1, fmt.Errorf("invalid 'index' query parameter %q: expected a file index from /files", indexStr)
+	}
+	file, err := fileAtIndex(t, index)
+	return file, index, err
+}
+
+// fileAtIndex returns the file at index, or errFileNotFound if there is none.
+func fileAtIndex(t *torrent.Torrent, index int) (*torrent.File, error) {
+	files := t.Files()
+	if index < 0 || index >= len(files) {
+		return nil, fmt.Errorf("%w: index %d is out of range, the torrent has %d file(s)", errFileNotFound, index, len(files))
+	}
+	return files[index], nil
+}
+
+// fileErrorStatus maps a requestedFile or fileAtIndex error to an HTTP status.
+func fileErrorStatus(err error) int {
+	if errors.Is(err, errFileNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// fileIndex returns the position of file in t.Files(), or -1.
+func fileIndex(t *torrent.Torrent, file *torrent.File) int {
+	for i, f := range t.Files() {
+		if f == file {
+			return i
+		}
+	}
+	return -1
+}
+
+// contentDisposition builds a Content-Disposition header of the given type
+// ("inline" or "attachment"). An ASCII filename is quoted with quotes and
+// backslashes escaped; any other is sent RFC 2231 encoded as filename*.
+func contentDisposition(dispositionType, filename string) string {
+	return mime.FormatMediaType(dispositionType, map[string]string{"filename": filename})
+}
+
+// isVideoFile reports whether filename has a known video extension.
+func isVideoFile(filename string) bool {
+	return strings.HasPrefix(getContentType(filename), "video/")
+}
+
+func getContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	// Video
+	case ".mp4", ".m4v":
+		return "video/mp4"
+	case ".mkv":
+		return "video/x-matroska"
+	case ".webm":
+		return "video/webm"
+	case ".avi":
+		return "video/x-msvideo"
+	case ".mov":
+		return "video/quicktime"
+	case ".ogv":
+		return "video/ogg"
+	case ".ts", ".m2ts":
+		return "video/mp2t"
+	case ".wmv":
+		return "video/x-ms-wmv"
+	case ".flv":
+		return "video/x-flv"
+	// Audio
+	case ".mp3":
+		return "audio/mpeg"
+	case ".flac":
+		return "audio/flac"
+	case ".m4a", ".m4b":
+		return "audio/mp4"
+	case ".aac":
+		return "audio/aac"
+	case ".ogg", ".oga":
+		return "audio/ogg"
+	case ".opus":
+		return "audio/opus"
+	case ".wav":
+		return "audio/wav"
+	case ".mka":
+		return "audio/x-matroska"
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// sniffTimeout bounds how long sniffContentType waits for a file's first bytes.
+const sniffTimeout = 10 * time.Second
+
+// sniffContentType detects the content type of a file whose extension is
+// unknown from its first 512 bytes, which requires the piece holding them. The
+// result is cached on the entry so range requests don't fetch it again. If the
+// bytes don't arrive in time, application/octet-stream is returned uncached.
+func (tc *TorrentClient) sniffContentType(ctx context.Context, entry *cacheEntry, index int, file *torrent.File) string {
+	if entry != nil {
+		entry.mu.Lock()
+		contentType, ok := entry.sniffedTypes[index]
+		entry.mu.Unlock()
+		if ok {
+			return contentType
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sniffTimeout)
+	defer cancel()
+	reader := file.NewReader()
+	defer reader.Close()
+	reader.SetContext(ctx)
+	reader.SetResponsive()
+	reader.SetReadahead(512)
+	buf := make([]byte, min(512, file.Length()))
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		slog.Debug("Could not sniff content type", "filename", file.DisplayPath(), "err", err)
+		return "application/octet-stream"
+	}
+	contentType := http.DetectContentType(buf)
+	slog.Debug("Sniffed content type", "filename", file.DisplayPath(), "contentType", contentType)
+
+	if entry != nil {
+		entry.mu.Lock()
+		if entry.sniffedTypes == nil {
+			entry.sniffedTypes = make(map[int]string)
+		}
+		entry.sniffedTypes[index] = contentType
+		entry.mu.Unlock()
+	}
+	return contentType
+}
+
+// --- HTTP Handlers (DEFINED ONLY ONCE) ---
+
+// ***************************************************************
+// ***               START OF UPDATED FUNCTION                   ***
+// ***************************************************************
+
+func (tc *TorrentClient) streamHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	peers, err := requestPeers(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	addRequestPeers(t, peers)
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+
+	file, index, err := tc.requestedFile(t, r)
+	if err != nil {
+		writeJSONError(w, fileErrorStatus(err), err.Error())
+		return
+	}
+
+	if entry := tc.cacheEntryFor(t); entry != nil {
+		internal := isInternalRequest(r)
+		if !tc.acquireStream(entry, internal) {
+			writeJSONError(w, http.StatusTooManyRequests, "Too many concurrent streams for this torrent")
+			return
+		}
+		defer tc.releaseStream(entry, internal)
+	}
+
+	filename := filepath.Base(file.DisplayPath())
+	fileSize := file.Length()
+	contentType := getContentType(filename)
+	if contentType == "application/octet-stream" {
+		contentType = tc.sniffContentType(r.Context(), tc.cacheEntryFor(t), index, file)
+	}
+
+	slog.Info("Streaming file", "infoHash", t.InfoHash().HexString(), "filename", filename, "size", fileSize, "range", r.Header.Get("Range"))
+
+	w.Header().Set("Content-Disposition", contentDisposition("inline", filename))
+	w.Header().Set("X-Filename", filename)
+	w.Header().Set("X-Filesize", strconv.FormatInt(fileSize, 10))
+	w.Header().Set("X-Content-Type", contentType)
+	w.Header().Set("Content-Type", contentType)
+
+	reader := file.NewReader()
+	defer reader.Close()
+	// Reads blocked on missing pieces return as soon as the client disconnects or
+	// the stall guard gives up, and the deferred Close drops the reader's readahead
+	// so those pieces stop being requested. Without this an abandoned seek keeps
+	// downloading.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	reader.SetContext(ctx)
+	reader.SetResponsive()
+	var content io.ReadSeeker = reader
+	readahead := tc.readaheadFor(magnetLink, index, file)
+	if tc.sequentialRequested(r) {
+		// A long readahead keeps every piece ahead of the read head wanted, so the
+		// client fetches them in roughly playback order instead of rarest-first.
+		readahead = max(readahead, sequentialReadaheadBytes)
+	}
+	if length, ok := boundedRangeLength(r.Header.Get("Range")); ok && readahead > length {
+		// A short range (a player probing the index, or a seek that fetches a
+		// chunk at a time) has no use for data past its end.
+		readahead = length
+	}
+	if readahead > 0 {
+		reader.SetReadahead(readahead)
+		seeker := &seekPrioritizingReader{ReadSeeker: reader, tc: tc, file: file, window: readahead}
+		defer tc.releaseSeekWindow(seeker)
+		content = seeker
+	}
+
+	// Torrent content never changes for an infohash, so the ETag and Last-Modified
+	// let download managers and caching proxies revalidate and resume safely.
+	var modTime time.Time
+	if entry := tc.cacheEntryFor(t); entry != nil {
+		modTime = entry.createdAt
+	}
+	w.Header().Set("ETag", streamETag(t, file))
+
+	// ServeContent handles Range and conditional requests (If-Range, If-None-Match,
+	// If-Modified-Since), Content-Length and the 206/304/416 statuses, seeking the
+	// torrent reader to the requested offset.
+	guard := tc.guardStalls(ctx, cancel, content)
+	if guard != nil {
+		content = guard
+	}
+	start := time.Now()
+	http.ServeContent(tc.bufferedWriter(w), r, filename, modTime, content)
+	if guard.hasStalled() {
+		slog.Warn("Stream stalled, no data from peers", "infoHash", t.InfoHash().HexString(), "filename", filename, "timeout", tc.streamReadTimeout)
+		return
+	}
+	logStreamEnd(r, "Stream", t, filename, start)
+}
+
+// stallGuard cancels a stream whose current read has been waiting for torrent
+// data longer than the timeout, e.g. because no peer has the needed piece. Only
+// time spent inside Read counts, so a paused player that stops consuming the
+// response isn't mistaken for a stall.
+type stallGuard struct {
+	io.ReadSeeker
+	readStart atomic.Int64 // UnixNano when the pending Read began, 0 between reads
+	stalled   atomic.Bool
+}
+
+// guardStalls wraps content in a stallGuard that calls cancel, which must cancel
+// the torrent reader's context, once a read stalls for -stream-read-timeout. It
+// returns nil when the timeout is disabled. The watchdog stops when ctx is done.
+func (tc *TorrentClient) guardStalls(ctx context.Context, cancel context.CancelFunc, content io.ReadSeeker) *stallGuard {
+	if tc.streamReadTimeout <= 0 {
+		return nil
+	}
+	g := &stallGuard{ReadSeeker: content}
+	go func() {
+		ticker := time.NewTicker(max(tc.streamReadTimeout/4, 100*time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if start := g.readStart.Load(); start != 0 && time.Since(time.Unix(0, start)) > tc.streamReadTimeout {
+					g.stalled.Store(true)
+					cancel()
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return g
+}
+
+func (g *stallGuard) Read(p []byte) (int, error) {
+	g.readStart.Store(time.Now().UnixNano())
+	defer g.readStart.Store(0)
+	return g.ReadSeeker.Read(p)
+}
+
+// hasStalled reports whether the guard cancelled the stream; a nil guard never does.
+func (g *stallGuard) hasStalled() bool {
+	return g != nil && g.stalled.Load()
+}
+
+// logStreamEnd logs how a stream or download response ended, telling a client
+// disconnect apart from a normal completion.
+func logStreamEnd(r *http.Request, kind string, t *torrent.Torrent, filename string, start time.Time) {
+	if r.Context().Err() != nil {
+		slog.Info(kind+" ended, client disconnected", "infoHash", t.InfoHash().HexString(), "filename", filename, "duration", time.Since(start))
+		return
+	}
+	slog.Debug(kind+" completed", "infoHash", t.InfoHash().HexString(), "filename", filename, "duration", time.Since(start))
+}
+
+// acquireStream counts a new stream of the entry's torrent, reporting false when
+// -max-streams-per-torrent are already open. Each stream holds a reader and its
+// buffers, so this stops one client from exhausting memory. Internal reads by
+// ffmpeg/ffprobe are counted but neither limited nor held against clients.
+func (tc *TorrentClient) acquireStream(entry *cacheEntry, internal bool) bool {
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if internal {
+		entry.internalStreams++
+	} else if open := entry.activeStreams - entry.internalStreams; tc.maxStreamsPerTorrent > 0 && open >= tc.maxStreamsPerTorrent {
+		slog.Warn("Rejecting stream, too many open", "infoHash", entry.torrent.InfoHash().HexString(), "open", open)
+		return false
+	}
+	entry.activeStreams++
+	return true
+}
+
+// activeStreamCount returns the number of open /stream and /download responses
+// across all cached torrents.
+func (tc *TorrentClient) activeStreamCount() int {
+	streams := 0
+	for _, key := range tc.cache.Keys() {
+		if val, ok := tc.cache.Peek(key); ok {
+			entry := val.(*cacheEntry)
+			entry.mu.Lock()
+			streams += entry.activeStreams
+			entry.mu.Unlock()
+		}
+	}
+	return streams
+}
+
+// releaseStream undoes acquireStream once a stream response ends, including when
+// the client disconnects.
+func (tc *TorrentClient) releaseStream(entry *cacheEntry, internal bool) {
+	entry.mu.Lock()
+	entry.activeStreams--
+	if internal {
+		entry.internalStreams--
+	}
+	entry.mu.Unlock()
+}
+
+// streamETag returns a strong ETag for a file of a torrent, derived from the
+// infohash and the file's index.
+func streamETag(t *torrent.Torrent, file *torrent.File) string {
+	return fmt.Sprintf("\"%s-%d\"", t.InfoHash().HexString(), fileIndex(t, file))
+}
+
+// bufferedWriter returns w with its body copies going through a buffer from
+// -stream-buffer-size's pool, or w itself when the pool is disabled.
+func (tc *TorrentClient) bufferedWriter(w http.ResponseWriter) http.ResponseWriter {
+	if tc.streamBuffers == nil {
+		return w
+	}
+	return &pooledBufferWriter{ResponseWriter: w, pool: tc.streamBuffers}
+}
+
+// pooledBufferWriter is an http.ResponseWriter whose ReadFrom, which io.Copy and
+// so http.ServeContent use, copies through a pooled buffer. Larger reads mean
+// fewer calls into the torrent reader per stream.
+type pooledBufferWriter struct {
+	http.ResponseWriter
+	pool *sync.Pool
+}
+
+func (w *pooledBufferWriter) ReadFrom(r io.Reader) (int64, error) {
+	buf := w.pool.Get().(*[]byte)
+	defer w.pool.Put(buf)
+	// Hide the wrapped writer's own ReadFrom, which would ignore buf.
+	return io.CopyBuffer(struct{ io.Writer }{w.ResponseWriter}, r, *buf)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *pooledBufferWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// seekPrioritizingReader raises the priority of the pieces after every absolute
+// seek past the start of the file, so a jump in playback is served first.
+type seekPrioritizingReader struct {
+	io.ReadSeeker
+	tc     *TorrentClient
+	file   *torrent.File
+	window int64
+}
+
+func (s *seekPrioritizingReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart && offset > 0 {
+		s.tc.prioritizeSeekWindow(s, s.file, offset, s.window)
+	}
+	return s.ReadSeeker.Seek(offset, whence)
+}
+
+// ***************************************************************
+// ***                 END OF UPDATED FUNCTION                   ***
+// ***************************************************************
+
+// downloadHandler serves a file of a torrent as an attachment, for non-media files
+// (archives, documents, images) that should be saved rather than played. Unlike
+// /stream it uses the plain extension-based MIME type and no playback readahead;
+// Range requests still work so download managers can resume.
+func (tc *TorrentClient) downloadHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+
+	file, _, err := tc.requestedFile(t, r)
+	if err != nil {
+		writeJSONError(w, fileErrorStatus(err), err.Error())
+		return
+	}
+
+	entry := tc.cacheEntryFor(t)
+	if entry != nil {
+		if !tc.acquireStream(entry, false) {
+			writeJSONError(w, http.StatusTooManyRequests, "Too many concurrent streams for this torrent")
+			return
+		}
+		defer tc.releaseStream(entry, false)
+	}
+
+	filename := filepath.Base(file.DisplayPath())
+	contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename)))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	slog.Info("Downloading file", "infoHash", t.InfoHash().HexString(), "filename", filename, "size", file.Length(), "range", r.Header.Get("Range"))
+
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", streamETag(t, file))
+
+	var modTime time.Time
+	if entry != nil {
+		modTime = entry.createdAt
+	}
+
+	reader := file.NewReader()
+	defer reader.Close()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	reader.SetContext(ctx)
+	var content io.ReadSeeker = reader
+	guard := tc.guardStalls(ctx, cancel, content)
+	if guard != nil {
+		content = guard
+	}
+	start := time.Now()
+	http.ServeContent(tc.bufferedWriter(w), r, filename, modTime, content)
+	if guard.hasStalled() {
+		slog.Warn("Download stalled, no data from peers", "infoHash", t.InfoHash().HexString(), "filename", filename, "timeout", tc.streamReadTimeout)
+		return
+	}
+	logStreamEnd(r, "Download", t, filename, start)
+}
+
+// internalStreamURL returns the loopback URL ffmpeg/ffprobe use to read a file from the torrent.
+// It points at the internal server, never the public one, so -listen-addr and
+// TLS don't affect it.
+func (tc *TorrentClient) internalStreamURL(magnetLink string, index int) string {
+	return fmt.Sprintf("http://%s/stream?url=%s&index=%d", tc.internalAddr, url.QueryEscape(magnetLink), index)
+}
+
+// internalRequestKey marks the context of requests served by the internal server.
+type internalRequestKey struct{}
+
+// isInternalRequest reports whether r came from ffmpeg/ffprobe via the internal server.
+func isInternalRequest(r *http.Request) bool {
+	internal, _ := r.Context().Value(internalRequestKey{}).(bool)
+	return internal
+}
+
+// startInternalServer serves the stream endpoint on a random loopback port for
+// ffmpeg and ffprobe. It bypasses the public server's middleware (auth, CORS), so
+// internal extraction traffic never needs credentials and can't be reached remotely.
+func (tc *TorrentClient) startInternalServer() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen on loopback for internal stream server: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		tc.streamHandler(w, r.WithContext(context.WithValue(r.Context(), internalRequestKey{}, true)))
+	})
+	tc.internalAddr = ln.Addr().String()
+	tc.internalServer = &http.Server{Handler: mux}
+	go func() {
+		slog.Info("Internal stream server listening", "addr", tc.internalAddr)
+		if err := tc.internalServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Internal stream server error", "err", err)
+		}
+	}()
+	return nil
+}
+
+// --- Buffer-Ahead ---
+
+const (
+	minReadaheadBytes = 1 << 20
+	maxReadaheadBytes = 256 << 20
+
+	// sequentialReadaheadBytes is the readahead used in sequential mode.
+	sequentialReadaheadBytes = maxReadaheadBytes
+)
+
+// sequentialRequested reports whether a stream request wants sequential download,
+// from its sequential query parameter or the -sequential default.
+func (tc *TorrentClient) sequentialRequested(r *http.Request) bool {
+	if v := r.URL.Query().Get("sequential"); v != "" {
+		if sequential, err := strconv.ParseBool(v); err == nil {
+			return sequential
+		}
+	}
+	return tc.sequential
+}
+
+// boundedRangeLength returns the length of a single "bytes=start-end" or
+// "bytes=-suffix" Range header. Open-ended ranges ("bytes=start-"), multiple
+// ranges and requests without a Range header aren't bounded.
+func boundedRangeLength(header string) (int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, false
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || endStr == "" {
+		return 0, false
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if startStr == "" {
+		return end, end > 0
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || end < start {
+		return 0, false
+	}
+	return end - start + 1, true
+}
+
+// readaheadFor returns the reader readahead in bytes for streaming file, derived
+// from -buffer-seconds and the file's average bitrate. The duration is probed in
+// the background on first use; until it is known, or when buffer-ahead is
+// disabled, -readahead-bytes is used. Zero means the library default.
+func (tc *TorrentClient) readaheadFor(magnetLink string, index int, file *torrent.File) int64 {
+	if tc.bufferSeconds <= 0 {
+		return tc.readaheadBytes
+	}
+	duration, known := tc.fileDuration(magnetLink, index, file)
+	if !known || duration <= 0 {
+		return tc.readaheadBytes
+	}
+	bytesPerSecond := float64(file.Length()) / duration
+	readahead := int64(bytesPerSecond * tc.bufferSeconds)
+	if readahead < minReadaheadBytes {
+		readahead = minReadaheadBytes
+	} else if readahead > maxReadaheadBytes {
+		readahead = maxReadaheadBytes
+	}
+	return readahead
+}
+
+// pieceRange is the piece indexes [begin, end).
+type pieceRange struct {
+	begin, end int
+}
+
+func (r pieceRange) contains(i int) bool {
+	return i >= r.begin && i < r.end
+}
+
+// prioritizeSeekWindow raises the priority of the pieces covering
+// [offset, offset+window) of file so a seek is served before anything else. With
+// a stream, it also drops the window raised by that stream's previous seek, so
+// pieces far behind its playback position stop competing for bandwidth; pieces
+// in another stream's window keep their priority. A nil stream (a one-off fetch
+// such as a thumbnail) leaves earlier windows alone.
+func (tc *TorrentClient) prioritizeSeekWindow(stream *seekPrioritizingReader, file *torrent.File, offset, window int64) {
+	t := file.Torrent()
+	entry := tc.cacheEntryFor(t)
+	if entry == nil {
+		return
+	}
+	pieceLength := t.Info().PieceLength
+	begin := int((file.Offset() + offset) / pieceLength)
+	end := int((file.Offset() + offset + window + pieceLength - 1) / pieceLength)
+	if fileEnd := file.EndPieceIndex(); end > fileEnd {
+		end = fileEnd
+	}
+	if begin >= end {
+		return
+	}
+	current := pieceRange{begin, end}
+
+	var dropped []int
+	if stream != nil {
+		entry.mu.Lock()
+		if entry.seekWindows == nil {
+			entry.seekWindows = make(map[*seekPrioritizingReader]pieceRange)
+		}
+		prev := entry.seekWindows[stream]
+		entry.seekWindows[stream] = current
+		dropped = entry.unclaimedPieces(prev)
+		entry.mu.Unlock()
+	}
+
+	for _, i := range dropped {
+		t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+	}
+	t.Piece(begin).SetPriority(torrent.PiecePriorityNow)
+	for i := begin + 1; i < end; i++ {
+		t.Piece(i).SetPriority(torrent.PiecePriorityHigh)
+	}
+	slog.Debug("Prioritized pieces for seek", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "firstPiece", begin, "lastPiece", end-1, "offset", offset)
+}
+
+// releaseSeekWindow drops the window of a finished stream, except for pieces
+// another stream's window still covers.
+func (tc *TorrentClient) releaseSeekWindow(stream *seekPrioritizingReader) {
+	t := stream.file.Torrent()
+	entry := tc.cacheEntryFor(t)
+	if entry == nil {
+		return
+	}
+	entry.mu.Lock()
+	prev, ok := entry.seekWindows[stream]
+	delete(entry.seekWindows, stream)
+	dropped := entry.unclaimedPieces(prev)
+	entry.mu.Unlock()
+	if !ok {
+		return
+	}
+	for _, i := range dropped {
+		t.Piece(i).SetPriority(torrent.PiecePriorityNone)
+	}
+}
+
+// unclaimedPieces returns the pieces of r that no stream's seek window covers.
+// entry.mu must be held.
+func (entry *cacheEntry) unclaimedPieces(r pieceRange) []int {
+	var pieces []int
+	for i := r.begin; i < r.end; i++ {
+		claimed := false
+		for _, w := range entry.seekWindows {
+			if w.contains(i) {
+				claimed = true
+				break
+			}
+		}
+		if !claimed {
+			pieces = append(pieces, i)
+		}
+	}
+	return pieces
+}
+
+// cacheEntryFor returns the cache entry of an active torrent without updating its recency.
+func (tc *TorrentClient) cacheEntryFor(t *torrent.Torrent) *cacheEntry {
+	if val, ok := tc.cache.Peek(t.InfoHash().HexString()); ok {
+		return val.(*cacheEntry)
+	}
+	return nil
+}
+
+// fileDuration returns the probed duration of file in seconds. The first call for
+// a file starts an ffprobe run and reports unknown; failed probes are cached as 0.
+func (tc *TorrentClient) fileDuration(magnetLink string, index int, file *torrent.File) (float64, bool) {
+	key := file.Torrent().InfoHash().HexString() + "/" + file.Path()
+	tc.durationsMu.Lock()
+	duration, found := tc.durations[key]
+	if !found {
+		// Mark as probing; ffprobe's own requests to /stream will see this entry.
+		tc.durations[key] = -1
+	}
+	tc.durationsMu.Unlock()
+	if found {
+		return duration, duration >= 0
+	}
+
+	go func() {
+		duration, err := probeDuration(tc.ctx, tc.internalStreamURL(magnetLink, index))
+		if err != nil {
+			slog.Warn("Could not probe duration, using default readahead", "file", file.DisplayPath(), "err", err)
+			duration = 0
+		} else {
+			slog.Info("Probed duration", "file", file.DisplayPath(), "seconds", duration)
+		}
+		tc.durationsMu.Lock()
+		tc.durations[key] = duration
+		tc.durationsMu.Unlock()
+	}()
+	return 0, false
+}
+
+// probeDuration runs ffprobe against streamURL and returns the container duration in seconds.
+func probeDuration(ctx context.Context, streamURL string) (float64, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe not found: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1", streamURL).Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe failed: %w", err)
+	}
+	duration, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected ffprobe output %q: %w", strings.TrimSpace(string(out)), err)
+	}
+	return duration, nil
+}
+
+// ProbeStream describes a subtitle or audio stream reported by ffprobe.
+// TypeIndex is the position among streams of the same type, as used by ffmpeg's
+// -map 0:s:<n> / 0:a:<n> specifiers.
+type ProbeStream struct {
+	Index        int    `json:"index"`
+	TypeIndex    int    `json:"typeIndex"`
+	CodecName    string `json:"codec"`
+	Language     string `json:"language,omitempty"`     // ISO 639-2 code from the stream tags
+	LanguageName string `json:"languageName,omitempty"` // Display name, or the raw code if unknown
+	Title        string `json:"title,omitempty"`
+}
+
+// languageNames maps ISO 639-2 codes, including the bibliographic variants
+// Matroska files often carry, to English display names.
+var languageNames = map[string]string{
+	"ara": "Arabic", "bul": "Bulgarian", "cat": "Catalan", "ces": "Czech", "cze": "Czech",
+	"chi": "Chinese", "zho": "Chinese", "dan": "Danish", "deu": "German", "ger": "German",
+	"dut": "Dutch", "nld": "Dutch", "ell": "Greek", "gre": "Greek", "eng": "English",
+	"est": "Estonian", "fas": "Persian", "per": "Persian", "fil": "Filipino", "fin": "Finnish",
+	"fra": "French", "fre": "French", "heb": "Hebrew", "hin": "Hindi", "hrv": "Croatian",
+	"hun": "Hungarian", "ice": "Icelandic", "isl": "Icelandic", "ind": "Indonesian",
+	"ita": "Italian", "jpn": "Japanese", "kor": "Korean", "lav": "Latvian", "lit": "Lithuanian",
+	"may": "Malay", "msa": "Malay", "nob": "Norwegian Bokmål", "nor": "Norwegian", "pol": "Polish",
+	"por": "Portuguese", "ron": "Romanian", "rum": "Romanian", "rus": "Russian",
+	"slk": "Slovak", "slo": "Slovak", "slv": "Slovenian", "spa": "Spanish", "srp": "Serbian",
+	"swe": "Swedish", "tam": "Tamil", "tel": "Telugu", "tha": "Thai", "tur": "Turkish",
+	"ukr": "Ukrainian", "urd": "Urdu", "vie": "Vietnamese",
+	"und": "Undetermined", "mul": "Multiple languages", "zxx": "No linguistic content",
+}
+
+// languageName returns the display name of an ISO 639-2 code, falling back to the
+// code itself when it isn't in languageNames.
+func languageName(code string) string {
+	if name, ok := languageNames[strings.ToLower(code)]; ok {
+		return name
+	}
+	return code
+}
+
+// subtitleTrackForLanguage returns the TypeIndex of the first subtitle stream in
+// lang, given as an ISO 639-2 code (either variant, e.g. "ger" or "deu") or an
+// English name such as "German".
+func subtitleTrackForLanguage(subtitles []ProbeStream, lang string) (int, bool) {
+	want := languageName(lang)
+	for _, s := range subtitles {
+		if s.Language != "" && strings.EqualFold(languageName(s.Language), want) {
+			return s.TypeIndex, true
+		}
+	}
+	return 0, false
+}
+
+// ProbeResult is the response of /probe.
+type ProbeResult struct {
+	Subtitles []ProbeStream `json:"subtitles"`
+	Audio     []ProbeStream `json:"audio"`
+}
+
+// probeStreams runs ffprobe against streamURL and returns its subtitle and audio streams.
+func probeStreams(ctx context.Context, streamURL string) (*ProbeResult, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe not found: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_streams", streamURL).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			Index     int               `json:"index"`
+			CodecName string            `json:"codec_name"`
+			CodecType string            `json:"codec_type"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %w", err)
+	}
+
+	result := &ProbeResult{Subtitles: []ProbeStream{}, Audio: []ProbeStream{}}
+	for _, st := range probe.Streams {
+		lang := st.Tags["language"]
+		ps := ProbeStream{Index: st.Index, CodecName: st.CodecName, Language: lang, LanguageName: languageName(lang), Title: st.Tags["title"]}
+		switch st.CodecType {
+		case "subtitle":
+			ps.TypeIndex = len(result.Subtitles)
+			result.Subtitles = append(result.Subtitles, ps)
+		case "audio":
+			ps.TypeIndex = len(result.Audio)
+			result.Audio = append(result.Audio, ps)
+		}
+	}
+	return result, nil
+}
+
+// Chapter is one chapter marker of a video file. Times are in seconds.
+type Chapter struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	Title string  `json:"title,omitempty"`
+}
+
+// ChaptersResult is the response of /chapters.
+type ChaptersResult struct {
+	Chapters []Chapter `json:"chapters"`
+
+	// ffprobe can only see chapters stored in data that has been downloaded.
+	// Matroska usually keeps them near the start, but some muxers write them
+	// at the end, so an incomplete file may report fewer chapters than it has.
+	FileComplete            bool   `json:"fileComplete"`
+	FileBytesCompleted      int64  `json:"fileBytesCompleted"`
+	FileBytesRemaining      int64  `json:"fileBytesRemaining"`
+	FileBytesRemainingHuman string `json:"fileBytesRemainingHuman"`
+}
+
+// probeChapters runs ffprobe against streamURL and returns its chapter markers.
+func probeChapters(ctx context.Context, streamURL string) ([]Chapter, error) {
+	ffprobePath, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe not found: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_chapters", streamURL).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var probe struct {
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			EndTime   string            `json:"end_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %w", err)
+	}
+
+	chapters := make([]Chapter, 0, len(probe.Chapters))
+	for _, c := range probe.Chapters {
+		start, _ := strconv.ParseFloat(c.StartTime, 64)
+		end, _ := strconv.ParseFloat(c.EndTime, 64)
+		chapters = append(chapters, Chapter{Start: start, End: end, Title: c.Tags["title"]})
+	}
+	return chapters, nil
+}
+
+// srtTimingPattern matches an SRT timing line. Milliseconds may be missing or
+// short, and anything after the end time (such as "X1:... Y2:..." coordinates)
+// is ignored.
+var srtTimingPattern = regexp.MustCompile(`^\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?\s*-->\s*(\d+):(\d{1,2}):(\d{1,2})(?:[,.](\d{1,3}))?`)
+
+// srtMarkupPattern matches the markup found in SRT text: HTML-like tags and ASS
+// override blocks such as {\an8} or {\i1}.
+var srtMarkupPattern = regexp.MustCompile(`</?[A-Za-z][^<>]*>|\{\\[^{}]*\}`)
+
+// srtEntityPattern matches a character reference, which VTT text may contain as is.
+var srtEntityPattern = regexp.MustCompile(`^&(?:[A-Za-z]+|#[0-9]+|#[xX][0-9A-Fa-f]+);`)
+
+// srtCueNumberPattern matches the numbering line that precedes an SRT timing line.
+var srtCueNumberPattern = regexp.MustCompile(`^\s*\d+\s*$`)
+
+// vttAlignments maps ASS numpad alignments ({\anN}) to VTT cue settings. 2, the
+// bottom centre, is the VTT default.
+var vttAlignments = map[string]string{
+	"1": "align:start", "3": "align:end",
+	"4": "line:50% align:start", "5": "line:50%", "6": "line:50% align:end",
+	"7": "line:0 align:start", "8": "line:0", "9": "line:0 align:end",
+}
+
+// srtToVtt converts SRT format subtitles to VTT format. Cue numbers are dropped,
+// even when a missing blank line leaves them stuck to the previous cue, and
+// cues with unreadable timings are skipped. Text goes through srtTextToVtt.
+// A leading BOM is dropped, CRLF and old Mac (CR) line endings are accepted, and
+// any number of blank lines may separate cues.
+func srtToVtt(srt string) string {
+	slog.Debug("srtToVtt: Starting conversion")
+	srt = strings.TrimPrefix(srt, "\ufeff")
+	srt = strings.ReplaceAll(strings.ReplaceAll(srt, "\r\n", "\n"), "\r", "\n")
+
+	type cue struct {
+		timing string
+		text   []string
+	}
+	var cues []cue
+	cueStart := true // Only blank lines and a cue number since the last cue's text
+	for _, line := range strings.Split(srt, "\n") {
+		m := srtTimingPattern.FindStringSubmatch(line)
+		// An unreadable timing where one is expected still starts a cue, which is
+		// skipped below; elsewhere "-->" is just text.
+		if m != nil || (cueStart && strings.Contains(line, "-->")) {
+			if n := len(cues); n > 0 {
+				if text := cues[n-1].text; len(text) > 0 && srtCueNumberPattern.MatchString(text[len(text)-1]) {
+					cues[n-1].text = text[:len(text)-1]
+				}
+			}
+			var timing string
+			if m != nil {
+				timing = vttTimestamp(m[1], m[2], m[3], m[4]) + " --> " + vttTimestamp(m[5], m[6], m[7], m[8])
+			}
+			cues = append(cues, cue{timing: timing})
+			cueStart = false
+			continue
+		}
+		// A blank line can't appear inside a VTT cue, so blank lines are dropped
+		// and stray lines up to the next timing stay with the current cue.
+		if strings.TrimSpace(line) == "" {
+			cueStart = true
+			continue
+		}
+		if !srtCueNumberPattern.MatchString(line) {
+			cueStart = false
+		}
+		if len(cues) > 0 {
+			cues[len(cues)-1].text = append(cues[len(cues)-1].text, line)
+		}
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	for _, c := range cues {
+		if c.timing == "" {
+			continue
+		}
+		var settings string
+		var text []string
+		for _, line := range c.text {
+			converted, lineSettings := srtTextToVtt(line)
+			if settings == "" {
+				settings = lineSettings
+			}
+			if strings.TrimSpace(converted) != "" {
+				text = append(text, converted)
+			}
+		}
+		if len(text) == 0 {
+			continue
+		}
+		vtt.WriteString(c.timing)
+		if settings != "" {
+			vtt.WriteString(" " + settings)
+		}
+		vtt.WriteString("\n" + strings.Join(text, "\n") + "\n\n")
+	}
+	slog.Debug("srtToVtt: Converted VTT content", "cues", len(cues), "length", vtt.Len())
+	return vtt.String()
+}
+
+// decodeSubtitleText returns subtitle file contents as UTF-8 text without a byte
+// order mark. Files with a UTF-16 BOM, as some Windows tools write them, are
+// decoded; anything else is taken as UTF-8.
+func decodeSubtitleText(data []byte) string {
+	var order func([]byte) uint16
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		order = func(b []byte) uint16 { return uint16(b[0]) | uint16(b[1])<<8 }
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		order = func(b []byte) uint16 { return uint16(b[0])<<8 | uint16(b[1]) }
+	default:
+		return strings.TrimPrefix(string(data), "\ufeff")
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 2; i+1 < len(data); i += 2 {
+		units = append(units, order(data[i:i+2]))
+	}
+	return string(utf16.Decode(units))
+}
+
+// vttTimestamp formats the hour, minute, second and fraction groups of an SRT
+// timestamp as HH:MM:SS.mmm.
+func vttTimestamp(h, m, sec, frac string) string {
+	hours, _ := strconv.Atoi(h)
+	minutes, _ := strconv.Atoi(m)
+	seconds, _ := strconv.Atoi(sec)
+	for len(frac) < 3 {
+		frac += "0" // ",5" is half a second
+	}
+	return fmt.Sprintf("%02d:%02d:%02d.%s", hours, minutes, seconds, frac)
+}
+
+// srtTextToVtt converts one line of SRT cue text to VTT. <i>, <b> and <u> are
+// kept, other tags such as <font> are dropped, and ASS override blocks that
+// leak into SRT become tags ({\i1}, {\b1}, {\u1} and their closing forms)
+// or, for {\anN}, the returned cue settings; other override codes are dropped.
+// Stray '<', '>' and '&' are escaped, so "-->" can't end up in cue text.
+func srtTextToVtt(line string) (text, settings string) {
+	var b strings.Builder
+	escape := func(s string) {
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '<':
+				b.WriteString("&lt;")
+			case s[i] == '>':
+				b.WriteString("&gt;")
+			case s[i] == '&' && !srtEntityPattern.MatchString(s[i:]):
+				b.WriteString("&amp;")
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+	}
+	last := 0
+	for _, loc := range srtMarkupPattern.FindAllStringIndex(line, -1) {
+		escape(line[last:loc[0]])
+		last = loc[1]
+		markup := line[loc[0]:loc[1]]
+		if markup[0] == '{' {
+			for _, code := range strings.Split(markup[2:len(markup)-1], "\\") {
+				code = strings.TrimSpace(code)
+				switch {
+				case strings.HasPrefix(code, "an") && len(code) == 3:
+					if s, ok := vttAlignments[code[2:]]; ok && settings == "" {
+						settings = s
+					}
+				case code == "i1", code == "b1", code == "u1":
+					b.WriteString("<" + code[:1] + ">")
+				case code == "i0", code == "b0", code == "u0":
+					b.WriteString("</" + code[:1] + ">")
+				}
+			}
+			continue
+		}
+		name := strings.ToLower(strings.TrimLeft(markup[1:len(markup)-1], "/"))
+		if i := strings.IndexAny(name, " \t"); i >= 0 {
+			name = name[:i]
+		}
+		if name == "i" || name == "b" || name == "u" {
+			if markup[1] == '/' {
+				b.WriteString("</" + name + ">")
+			} else {
+				b.WriteString("<" + name + ">")
+			}
+		}
+	}
+	escape(line[last:])
+	return b.String(), settings
+}
+
+func (tc *TorrentClient) cleanupTorrentAssociatedFiles(infoHash string) {
+	tc.vttFileMapMu.Lock()
+	defer tc.vttFileMapMu.Unlock()
+
+	keysToDelete := []string{}
+	for key, filePath := range tc.vttFileMap {
+		if strings.HasPrefix(key, infoHash+"_") { // Assuming vttKey starts with infoHash
+			slog.Info("Deleting VTT file", "infoHash", infoHash, "path", filePath)
+			if err := os.Remove(filePath); err != nil {
+				slog.Error("Error deleting VTT file", "infoHash", infoHash, "path", filePath, "err", err)
+			}
+			keysToDelete = append(keysToDelete, key)
+		}
+	}
+
+	for _, key := range keysToDelete {
+		delete(tc.vttFileMap, key)
+		if tc.db == nil {
+			continue
+		}
+		if err := tc.db.Delete([]byte(vttKeyPrefix + key)); err != nil {
+			slog.Error("Error deleting VTT mapping from LotusDB", "key", key, "err", err)
+		}
+	}
+
+	tc.durationsMu.Lock()
+	for key := range tc.durations {
+		if strings.HasPrefix(key, infoHash+"/") {
+			delete(tc.durations, key)
+		}
+	}
+	tc.durationsMu.Unlock()
+
+	// --- New ASS and Log file cleanup ---
+	// Covers every file index and subtitle track (infoHash_index_subIndex.ass/.log)
+	// and thumbnail (infoHash_index_millis.jpg), in the download directory and in
+	// session subdirectories.
+	patterns := []string{
+		filepath.Join(tc.downloadDir, fmt.Sprintf("%s_*.ass", infoHash)),
+		filepath.Join(tc.downloadDir, fmt.Sprintf("%s_*.log", infoHash)),
+		filepath.Join(tc.downloadDir, fmt.Sprintf("%s_*.jpg", infoHash)),
+	}
+	if tc.perSessionDirs {
+		patterns = append(patterns,
+			filepath.Join(tc.downloadDir, "*", fmt.Sprintf("%s_*.ass", infoHash)),
+			filepath.Join(tc.downloadDir, "*", fmt.Sprintf("%s_*.log", infoHash)),
+			filepath.Join(tc.downloadDir, "*", fmt.Sprintf("%s_*.jpg", infoHash)))
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			slog.Error("Error globbing files", "pattern", pattern, "err", err)
+			continue
+		}
+		for _, file := range matches {
+			slog.Info("Deleting associated file", "infoHash", infoHash, "path", file)
+			if err := os.Remove(file); err != nil {
+				slog.Error("Error deleting associated file", "infoHash", infoHash, "path", file, "err", err)
+			}
+		}
+	}
+	// --- End New ASS and Log file cleanup ---
+}
+
+func (tc *TorrentClient) downloadSubtitleHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("downloadSubtitleHandler: Received request", "magnet", r.URL.Query().Get("url"), "filePath", r.URL.Query().Get("filePath"))
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+
+	filePath := r.URL.Query().Get("filePath")
+	if filePath == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'filePath' query parameter")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "vtt"
+	}
+	if format != "vtt" && format != "srt" {
+		writeJSONError(w, http.StatusBadRequest, "Invalid 'format' query parameter (expected 'vtt' or 'srt')")
+		return
+	}
+	download := r.URL.Query().Get("download") == "true"
+	dispositionType := "inline"
+	if download {
+		dispositionType = "attachment"
+	}
+	baseName := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+
+	infoHash, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+
+	var targetFile *torrent.File
+	for _, file := range t.Files() {
+		if file.DisplayPath() == filePath {
+			targetFile = file
+			break
+		}
+	}
+
+	if targetFile == nil {
+		writeJSONError(w, http.StatusNotFound, "Subtitle file not found in torrent")
+		return
+	}
+
+	reader := targetFile.NewReader()
+	defer reader.Close()
+
+	srtBytes, err := io.ReadAll(reader)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read subtitle file")
+		return
+	}
+
+	srtText := decodeSubtitleText(srtBytes)
+	if format == "srt" {
+		// Re-encoded as UTF-8, without a BOM, to match the declared charset.
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", contentDisposition(dispositionType, baseName+".srt"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(srtText)))
+		w.Write([]byte(srtText))
+		return
+	}
+
+	vttContent := srtToVtt(srtText)
+
+	// Construct a deterministic VTT filename: infoHash_filePathHash.vtt
+	// Use a hash of infoHash and filePath to ensure uniqueness and consistency
+	uniqueKey := infoHash + filePath
+	hash := sha256.Sum256([]byte(uniqueKey))
+	vttFilename := fmt.Sprintf("%s_%s.vtt", infoHash, hex.EncodeToString(hash[:]))
+	vttFilePath := filepath.Join(dataDir, vttFilename)
+
+	if download {
+		// Save the converted file itself rather than a key for /stream-vtt.
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Header().Set("Content-Disposition", contentDisposition(dispositionType, baseName+".vtt"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(vttContent)))
+		w.Write([]byte(vttContent))
+		return
+	}
+
+	// Check if this VTT file already exists and is valid
+	if _, err := os.Stat(vttFilePath); err == nil {
+		slog.Debug("downloadSubtitleHandler: Found existing VTT file", "infoHash", infoHash, "path", vttFilePath)
+		// File exists, assume it's valid and return its key
+		tc.registerVttFile(vttFilename, vttFilePath)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"vttKey": vttFilename})
+		return
+	}
+
+	// Write VTT content to file
+	if err := tc.ensureDataDir(dataDir); err != nil {
+		slog.Error("Error creating session directory", "path", dataDir, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save VTT file")
+		return
+	}
+	if err := os.WriteFile(vttFilePath, []byte(vttContent), 0644); err != nil {
+		slog.Error("Error writing VTT file", "infoHash", infoHash, "path", vttFilePath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to save VTT file")
+		return
+	}
+	slog.Info("downloadSubtitleHandler: Wrote new VTT file", "infoHash", infoHash, "path", vttFilePath)
+
+	// Store VTT filename (key) to full path mapping
+	tc.registerVttFile(vttFilename, vttFilePath)
+
+	// Respond with the VTT filename (which acts as the key for streamVttHandler)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"vttKey": vttFilename})
+}
+
+func (tc *TorrentClient) streamVttHandler(w http.ResponseWriter, r *http.Request) {
+	vttFilename := r.URL.Query().Get("key")
+	slog.Debug("streamVttHandler: Received request", "key", vttFilename)
+	if vttFilename == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'key' query parameter (VTT filename)")
+		return
+	}
+
+	tc.vttFileMapMu.Lock()
+	vttFilePath, found := tc.vttFileMap[vttFilename]
+	tc.vttFileMapMu.Unlock()
+
+	if !found && vttKeyPattern.MatchString(vttFilename) {
+		// The key may predate a restart that lost its mapping; VTT files are
+		// written to the request's data directory under their key.
+		dataDir, ok := tc.requestDataDir(w, r)
+		if !ok {
+			return
+		}
+		candidate := filepath.Join(dataDir, vttFilename)
+		if _, err := os.Stat(candidate); err == nil {
+			slog.Info("streamVttHandler: Recovered VTT file from disk", "key", vttFilename)
+			tc.registerVttFile(vttFilename, candidate)
+			vttFilePath, found = candidate, true
+		}
+	}
+
+	if !found {
+		slog.Warn("streamVttHandler: VTT file not found", "key", vttFilename)
+		writeJSONError(w, http.StatusNotFound, "VTT file not found or no longer active")
+		return
+	}
+	slog.Debug("streamVttHandler: Found VTT file", "key", vttFilename, "path", vttFilePath)
+
+	vttFile, err := os.Open(vttFilePath)
+	if err != nil {
+		slog.Error("Error reading VTT file", "path", vttFilePath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read VTT file")
+		return
+	}
+	defer vttFile.Close()
+	fi, err := vttFile.Stat()
+	if err != nil {
+		slog.Error("Error reading VTT file", "path", vttFilePath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read VTT file")
+		return
+	}
+
+	// VTT keys embed the infohash and a sha256 of the subtitle path, so the content
+	// for a key never changes and the key itself serves as a strong ETag.
+	// ServeContent handles Range, If-Range, If-None-Match and If-Modified-Since.
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(vttFilename, ".vtt")+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	http.ServeContent(w, r, vttFilename, fi.ModTime(), vttFile)
+}
+
+// probeHandler lists the subtitle and audio streams embedded in a torrent file,
+// so the frontend can choose which track to extract.
+func (tc *TorrentClient) probeHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing or invalid 'index' query parameter")
+		return
+	}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Stream probing is unavailable: ffprobe was not found in the system PATH.")
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+	file, err := fileAtIndex(t, index)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	slog.Info("Probing streams", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "index", index)
+	result, err := probeStreams(r.Context(), tc.internalStreamURL(magnetLink, index))
+	if err != nil {
+		slog.Error("Error probing streams", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "err", err)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to probe file: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// chaptersHandler lists the chapter markers of a torrent file, along with how
+// much of the file has been downloaded.
+func (tc *TorrentClient) chaptersHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing or invalid 'index' query parameter")
+		return
+	}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Chapter extraction is unavailable: ffprobe was not found in the system PATH.")
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+	file, err := fileAtIndex(t, index)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	slog.Info("Probing chapters", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "index", index)
+	chapters, err := probeChapters(r.Context(), tc.internalStreamURL(magnetLink, index))
+	if err != nil {
+		slog.Error("Error probing chapters", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "err", err)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to probe file: %v", err))
+		return
+	}
+
+	result := ChaptersResult{Chapters: chapters, FileBytesCompleted: file.BytesCompleted()}
+	result.FileBytesRemaining = file.Length() - result.FileBytesCompleted
+	result.FileBytesRemainingHuman = humanReadableSize(result.FileBytesRemaining)
+	result.FileComplete = result.FileBytesRemaining == 0
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// transcodeWriter passes ffmpeg's output to the client, flushing every chunk so
+// playback can start before the transcode finishes. The response headers are
+// sent with the first chunk, so a failure before any output can still be
+// reported as a JSON error.
+type transcodeWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (t *transcodeWriter) Write(b []byte) (int, error) {
+	if !t.wrote {
+		t.wrote = true
+		t.w.Header().Set("Content-Type", "video/mp4")
+		t.w.Header().Set("Cache-Control", "no-store")
+	}
+	n, err := t.w.Write(b)
+	if f, ok := t.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// parseSeconds parses a position in a file in seconds, rejecting negative and
+// non-finite values, which ffmpeg can't seek to.
+func parseSeconds(v string) (float64, bool) {
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds < 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// transcodeHandler streams a torrent file re-encoded by ffmpeg to fragmented
+// MP4 with H.264 video and stereo AAC audio, which every browser can play. The
+// output has no length and can't be seeked; "start" begins it at a position
+// in seconds instead.
+func (tc *TorrentClient) transcodeHandler(w http.ResponseWriter, r *http.Request) {
+	if !tc.transcodeEnabled {
+		writeJSONError(w, http.StatusServiceUnavailable, "Transcoding is not enabled. Start the server with -enable-transcode to enable it.")
+		return
+	}
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	if !tc.subtitleExtractionAvailable {
+		writeJSONError(w, http.StatusServiceUnavailable, "Transcoding is unavailable: ffmpeg was not found in the system PATH when the server started.")
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing or invalid 'index' query parameter")
+		return
+	}
+	var start float64
+	if v := r.URL.Query().Get("start"); v != "" {
+		if start, ok = parseSeconds(v); !ok {
+			writeJSONError(w, http.StatusBadRequest, "Invalid 'start' query parameter: must be a non-negative number of seconds")
+			return
+		}
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+	file, err := fileAtIndex(t, index)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "Transcoding is unavailable: ffmpeg was not found in the system PATH.")
+		return
+	}
+
+	args := []string{"-v", "error"}
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args, "-i", tc.internalStreamURL(magnetLink, index),
+		"-map", "0:v:0", "-map", "0:a:0?", "-sn",
+		"-c:v", "libx264", "-preset", "veryfast", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-ac", "2",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4", "pipe:1")
+	// Killed when the client goes away, which also ends its internal /stream read.
+	cmd := exec.CommandContext(r.Context(), ffmpegPath, args...)
+	out := &transcodeWriter{w: w}
+	var stderr bytes.Buffer
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+
+	slog.Info("Starting transcode", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "index", index, "start", start)
+	begin := time.Now()
+	err = cmd.Run()
+	switch {
+	case r.Context().Err() != nil:
+		slog.Info("Transcode ended by client", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "duration", time.Since(begin).Round(time.Second))
+	case err != nil:
+		slog.Error("Transcode failed", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "err", err, "stderr", strings.TrimSpace(stderr.String()))
+		if !out.wrote {
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to transcode file: %v", err))
+		}
+	default:
+		slog.Info("Transcode finished", "infoHash", t.InfoHash().HexString(), "file", file.DisplayPath(), "duration", time.Since(begin).Round(time.Second))
+	}
+}
+
+// ThumbnailPending is the 202 response of /thumbnail while the frame can't be
+// grabbed yet. Status is "probing" while the file's duration is unknown, or
+// "downloading" while the data around the requested time is missing.
+type ThumbnailPending struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// defaultThumbnailTime is the position /thumbnail grabs without a "time"
+// parameter, past the black frames and logos most videos open with.
+const defaultThumbnailTime = 30.0
+
+// thumbnailHandler serves a JPEG frame of a torrent file at the requested time.
+// Frames are cached next to the subtitle files as <infohash>_<index>_<millis>.jpg
+// and removed with them when the torrent leaves the cache.
+func (tc *TorrentClient) thumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	if !tc.subtitleExtractionAvailable {
+		writeJSONError(w, http.StatusServiceUnavailable, "Thumbnails are unavailable: ffmpeg was not found in the system PATH when the server started.")
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing or invalid 'index' query parameter")
+		return
+	}
+	seconds := defaultThumbnailTime
+	if v := r.URL.Query().Get("time"); v != "" {
+		if seconds, ok = parseSeconds(v); !ok {
+			writeJSONError(w, http.StatusBadRequest, "Invalid 'time' query parameter: must be a non-negative number of seconds")
+			return
+		}
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+	file, err := fileAtIndex(t, index)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	infoHash := t.InfoHash().HexString()
+	millis := int64(seconds * 1000)
+	thumbnailName := fmt.Sprintf("%s_%d_%d.jpg", infoHash, index, millis)
+	thumbnailPath := filepath.Join(dataDir, thumbnailName)
+
+	if _, err := os.Stat(thumbnailPath); err != nil {
+		// The byte offset of the frame is estimated from the average bitrate, so
+		// the duration has to be known before the data can be checked.
+		duration, known := tc.fileDuration(magnetLink, index, file)
+		if !known {
+			w.Header().Set("Retry-After", "5")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(ThumbnailPending{Status: "probing", Message: "The file's duration is being probed; retry shortly."})
+			return
+		}
+		if duration > 0 {
+			if seconds >= duration {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("'time' is past the end of the file (%.0f seconds)", duration))
+				return
+			}
+			bytesPerSecond := float64(file.Length()) / duration
+			offset := int64(seconds * bytesPerSecond)
+			window := max(int64(2*bytesPerSecond), t.Info().PieceLength)
+			if !fileRangeComplete(file, offset, window) {
+				tc.prioritizeSeekWindow(nil, file, offset, window)
+				w.Header().Set("Retry-After", "5")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusAccepted)
+				json.NewEncoder(w).Encode(ThumbnailPending{Status: "downloading", Message: fmt.Sprintf("The data at %g seconds hasn't been downloaded yet; it has been prioritized, retry shortly.", seconds)})
+				return
+			}
+		}
+		if err := tc.ensureDataDir(dataDir); err != nil {
+			slog.Error("Error creating session directory", "path", dataDir, "err", err)
+			writeJSONError(w, http.StatusInternalServerError, "Failed to create the thumbnail directory")
+			return
+		}
+		if err := grabThumbnail(r.Context(), tc.internalStreamURL(magnetLink, index), seconds, thumbnailPath); err != nil {
+			slog.Error("Error grabbing thumbnail", "infoHash", infoHash, "file", file.DisplayPath(), "time", seconds, "err", err)
+			writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Failed to grab thumbnail: %v", err))
+			return
+		}
+		slog.Info("Grabbed thumbnail", "infoHash", infoHash, "file", file.DisplayPath(), "time", seconds, "path", thumbnailPath)
+	}
+
+	f, err := os.Open(thumbnailPath)
+	if err != nil {
+		slog.Error("Error reading thumbnail", "path", thumbnailPath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read thumbnail")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		slog.Error("Error reading thumbnail", "path", thumbnailPath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read thumbnail")
+		return
+	}
+	// Like VTT keys, the name fixes the content, so it serves as a strong ETag.
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(thumbnailName, ".jpg")+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, thumbnailName, fi.ModTime(), f)
+}
+
+// fileRangeComplete reports whether the pieces covering [offset, offset+length)
+// of file have all been downloaded.
+func fileRangeComplete(file *torrent.File, offset, length int64) bool {
+	t := file.Torrent()
+	pieceLength := t.Info().PieceLength
+	begin := max(int((file.Offset()+offset)/pieceLength), file.BeginPieceIndex())
+	end := int((file.Offset() + offset + length + pieceLength - 1) / pieceLength)
+	if fileEnd := file.EndPieceIndex(); end > fileEnd {
+		end = fileEnd
+	}
+	for i := begin; i < end; i++ {
+		if !t.PieceState(i).Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// grabThumbnail has ffmpeg write the frame of streamURL at seconds to path as a
+// JPEG. The frame is written to a temporary file first, so concurrent requests
+// and failed runs never leave a partial image at path.
+func grabThumbnail(ctx context.Context, streamURL string, seconds float64, path string) error {
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return fmt.Errorf("ffmpeg not found: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-v", "error", "-y",
+		"-ss", strconv.FormatFloat(seconds, 'f', 3, 64), "-i", streamURL,
+		"-frames:v", "1", "-q:v", "3", "-f", "image2", "-c:v", "mjpeg", "-update", "1", tmp.Name())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if fi, err := os.Stat(tmp.Name()); err != nil || fi.Size() == 0 {
+		return errors.New("ffmpeg produced no frame")
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (tc *TorrentClient) extractSubtitlesHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	if !tc.subtitleExtractionAvailable {
+		writeJSONError(w, http.StatusServiceUnavailable, "Subtitle extraction is unavailable: ffmpeg was not found in the system PATH when the server started.")
+		return
+	}
+	indexStr := r.URL.Query().Get("index")
+	index, err := strconv.Atoi(indexStr)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Missing or invalid 'index' query parameter")
+		return
+	}
+	subIndex := 0
+	lang := r.URL.Query().Get("lang")
+	if subIndexStr := r.URL.Query().Get("subIndex"); subIndexStr != "" {
+		if lang != "" {
+			writeJSONError(w, http.StatusBadRequest, "Use either 'subIndex' or 'lang', not both")
+			return
+		}
+		subIndex, err = strconv.Atoi(subIndexStr)
+		if err != nil || subIndex < 0 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid 'subIndex' query parameter")
+			return
+		}
+	}
+
+	infoHash, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+
+	file, err := fileAtIndex(t, index)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	inputStreamURL := tc.internalStreamURL(magnetLink, index)
+
+	// With lang, the track is picked from the probed stream tags, so the file is
+	// probed before the output names (which carry the track) are known.
+	var probe *ProbeResult
+	var probeErr error
+	if lang != "" {
+		probe, probeErr = probeStreams(r.Context(), inputStreamURL)
+		if probeErr != nil {
+			slog.Warn("Could not probe subtitle tracks, extracting the first one", "infoHash", infoHash, "file", file.DisplayPath(), "lang", lang, "err", probeErr)
+		} else if track, ok := subtitleTrackForLanguage(probe.Subtitles, lang); ok {
+			subIndex = track
+		} else {
+			slog.Info("No subtitle track in the requested language, extracting the first one", "infoHash", infoHash, "file", file.DisplayPath(), "lang", lang)
+		}
+	}
+
+	subtitleFileName := fmt.Sprintf("%s_%d_%d.ass", infoHash, index, subIndex)
+	subtitleFilePath := filepath.Join(dataDir, subtitleFileName)
+	logFileName := fmt.Sprintf("%s_%d_%d.log", infoHash, index, subIndex)
+	logFilePath := filepath.Join(dataDir, logFileName)
+
+	response := map[string]string{
+		"logFile":      logFileName,
+		"subtitleFile": subtitleFileName,
+		"subIndex":     strconv.Itoa(subIndex),
+	}
+
+	// Like converted VTT files, a finished extraction is reused unless force=true.
+	if r.URL.Query().Get("force") != "true" && tc.extractionReusable(subtitleFilePath, logFilePath, logFileName) {
+		slog.Info("Reusing extracted subtitles", "infoHash", infoHash, "index", index, "subIndex", subIndex, "path", subtitleFilePath)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Claim the extraction before touching its files. A request for one that is
+	// already queued or running gets the same files to poll instead of starting a
+	// second ffmpeg on them.
+	tc.extractionsMu.Lock()
+	running := tc.extractions[logFileName]
+	tc.extractions[logFileName] = true
+	tc.extractionsMu.Unlock()
+	if running {
+		slog.Info("Subtitle extraction already running", "infoHash", infoHash, "index", index, "subIndex", subIndex)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	started := false
+	defer func() {
+		if !started {
+			tc.extractionsMu.Lock()
+			delete(tc.extractions, logFileName)
+			tc.extractionsMu.Unlock()
+		}
+	}()
+
+	// Reject tracks that don't exist up front; otherwise ffmpeg only fails after
+	// buffering the file. Without ffprobe, ffmpeg's own error ends up in the log.
+	if lang == "" {
+		probe, probeErr = probeStreams(r.Context(), inputStreamURL)
+	}
+	if probeErr != nil {
+		slog.Warn("Could not probe subtitle tracks, skipping validation", "infoHash", infoHash, "file", file.DisplayPath(), "err", probeErr)
+	} else if subIndex >= len(probe.Subtitles) {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("Subtitle track %d not found: the file has %d subtitle track(s)", subIndex, len(probe.Subtitles)))
+		return
+	}
+
+	// Clean up old log file if it exists
+	os.Remove(logFilePath)
+	if err := tc.ensureDataDir(dataDir); err != nil {
+		slog.Error("Error creating session directory", "path", dataDir, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to create the subtitle directory")
+		return
+	}
+
+	ffmpegPath, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		slog.Error("ffmpeg executable not found in PATH", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "ffmpeg executable not found. Please ensure ffmpeg is installed and in your system's PATH.")
+		return
+	}
+
+	cmd := exec.Command(ffmpegPath, "-y", "-i", inputStreamURL, "-map", fmt.Sprintf("0:s:%d", subIndex), "-c", "copy", subtitleFilePath)
+
+	// ffmpeg demuxes the whole file to collect the subtitle packets. Queue every
+	// piece of it instead of only the readahead window ahead of ffmpeg's reads, so
+	// the download isn't paced by the extraction.
+	file.Download()
+
+	started = true
+	go func() {
+		defer func() {
+			tc.extractionsMu.Lock()
+			delete(tc.extractions, logFileName)
+			tc.extractionsMu.Unlock()
+		}()
+		if !tc.acquireExtractionSlot(logFileName) {
+			return
+		}
+		defer tc.releaseExtractionSlot()
+		slog.Info("Starting subtitle extraction", "infoHash", infoHash, "name", t.Name(), "index", index, "subIndex", subIndex)
+		slog.Debug("Executing command", "cmd", cmd.String())
+
+		logFile, err := os.Create(logFilePath)
+		if err != nil {
+			slog.Error("Error creating log file for extraction", "path", logFilePath, "err", err)
+			return
+		}
+		defer logFile.Close()
+
+		cmd.Stderr = logFile
+		cmd.Stdout = logFile
+
+		        cmdErr := cmd.Run()
+				if cmdErr != nil {
+					slog.Error("Error during subtitle extraction", "infoHash", infoHash, "index", index, "subIndex", subIndex, "err", cmdErr)
+					logFile.WriteString(fmt.Sprintf("\n\nExtraction failed: %v", cmdErr))
+					metricSubtitleExtractions.WithLabelValues("failure").Inc()
+				} else {
+					// Check if the file was created and has content
+					info, statErr := os.Stat(subtitleFilePath)
+					if statErr != nil || info.Size() == 0 {
+						slog.Error("Subtitle extraction seemed to succeed, but output file is missing or empty", "infoHash", infoHash, "path", subtitleFilePath)
+						logFile.WriteString("\n\nExtraction failed: Output file is missing or empty.")
+						metricSubtitleExtractions.WithLabelValues("failure").Inc()
+					} else {
+						slog.Info("Subtitle extraction finished", "infoHash", infoHash, "name", t.Name(), "index", index, "subIndex", subIndex, "path", subtitleFilePath)
+						logFile.WriteString("\n\nExtraction finished successfully.")
+						metricSubtitleExtractions.WithLabelValues("success").Inc()
+					}
+				}	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// acquireExtractionSlot waits in the extraction queue until fewer than
+// -max-concurrent-extractions ffmpeg processes run. It returns false if the
+// client shuts down first.
+func (tc *TorrentClient) acquireExtractionSlot(logFileName string) bool {
+	if tc.extractionSlots == nil {
+		return true
+	}
+	select {
+	case tc.extractionSlots <- struct{}{}:
+		return true
+	default:
+	}
+
+	tc.extractionsMu.Lock()
+	tc.extractionQueue = append(tc.extractionQueue, logFileName)
+	queued := len(tc.extractionQueue)
+	tc.extractionsMu.Unlock()
+	slog.Info("Subtitle extraction queued", "logFile", logFileName, "position", queued)
+	defer func() {
+		tc.extractionsMu.Lock()
+		tc.extractionQueue = slices.DeleteFunc(tc.extractionQueue, func(name string) bool { return name == logFileName })
+		tc.extractionsMu.Unlock()
+	}()
+
+	select {
+	case tc.extractionSlots <- struct{}{}:
+		return true
+	case <-tc.ctx.Done():
+		return false
+	}
+}
+
+func (tc *TorrentClient) releaseExtractionSlot() {
+	if tc.extractionSlots != nil {
+		<-tc.extractionSlots
+	}
+}
+
+// extractionReusable reports whether an earlier extraction left a complete
+// subtitle file: it must be non-empty, no extraction may be writing it, and its
+// log, if kept, must not record a failure. A missing log is recreated so that
+// /extract-status reports success.
+func (tc *TorrentClient) extractionReusable(subtitleFilePath, logFilePath, logFileName string) bool {
+	tc.extractionsMu.Lock()
+	running := tc.extractions[logFileName]
+	tc.extractionsMu.Unlock()
+	if running {
+		return false
+	}
+	if info, err := os.Stat(subtitleFilePath); err != nil || info.Size() == 0 {
+		return false
+	}
+	logContent, err := os.ReadFile(logFilePath)
+	if err == nil {
+		return strings.Contains(string(logContent), "Extraction finished successfully")
+	}
+	if err := os.WriteFile(logFilePath, []byte("Extraction finished successfully (reused the output of an earlier extraction).\n"), 0644); err != nil {
+		slog.Warn("Error recreating extraction log", "path", logFilePath, "err", err)
+	}
+	return true
+}
+
+// extractionFilePath resolves the name of an extracted subtitle or log file to its
+// path in dataDir, rejecting names that would escape it.
+func extractionFilePath(dataDir, fileName string) (string, bool) {
+	// Extracted subtitles and logs are flat files (infoHash_index_subIndex.ass/.log), so any
+	// separator or parent reference is an attempt to escape the download directory.
+	if strings.ContainsAny(fileName, `/\`) || fileName == "." || fileName == ".." {
+		return "", false
+	}
+	filePath := filepath.Join(dataDir, fileName)
+	if rel, err := filepath.Rel(dataDir, filePath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filePath, true
+}
+
+func (tc *TorrentClient) serveSubtitleFileHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("file")
+	if fileName == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'file' query parameter")
+		return
+	}
+
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	filePath, ok := extractionFilePath(dataDir, fileName)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Invalid file path")
+		return
+	}
+
+	if strings.HasSuffix(fileName, ".log") {
+		// Extraction logs are polled for progress and must never be cached.
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		// Extracted subtitles may still be growing; revalidate via Last-Modified.
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeFile(w, r, filePath)
+}
+
+
+
+
+
+// --- Extraction Status ---
+
+// extractLogTailSize is how much of the end of an ffmpeg log /extract-status reads.
+// Progress lines are rewritten in place with \r, so the log grows steadily.
+const extractLogTailSize = 64 << 10
+
+var (
+	ffmpegTimeRegex     = regexp.MustCompile(`time=\s*(\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+	ffmpegSizeRegex     = regexp.MustCompile(`size=\s*(\S+)`)
+	ffmpegDurationRegex = regexp.MustCompile(`Duration:\s*(\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+)
+
+// ExtractStatus is the response of /extract-status.
+type ExtractStatus struct {
+	Status          string  `json:"status"` // "queued", "running", "success", "failure" or "unknown"
+	Running         bool    `json:"running"`
+	Time            string  `json:"time,omitempty"`
+	PositionSeconds float64 `json:"positionSeconds"`
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Percent         float64 `json:"percent,omitempty"`
+	Size            string  `json:"size,omitempty"`
+	Message         string  `json:"message,omitempty"`
+
+	// ffmpeg has to read the whole video to collect the subtitle packets, and the
+	// torrent reader blocks on pieces that aren't downloaded yet. These report how
+	// much of the file is still missing while the torrent is active.
+	FileBytesCompleted      int64  `json:"fileBytesCompleted,omitempty"`
+	FileBytesRemaining      int64  `json:"fileBytesRemaining,omitempty"`
+	FileBytesRemainingHuman string `json:"fileBytesRemainingHuman,omitempty"`
+
+	// While queued behind -max-concurrent-extractions: the 1-based position in
+	// the queue and the number of extractions waiting.
+	QueuePosition int `json:"queuePosition,omitempty"`
+	QueueLength   int `json:"queueLength,omitempty"`
+}
+
+// extractionLogPattern matches extraction log names: <infohash>_<index>_<subIndex>.log
+var extractionLogPattern = regexp.MustCompile(`^([0-9a-f]{40})_(\d+)_\d+\.log$`)
+
+// addFileProgress fills in how much of the video being extracted has been
+// downloaded, if its torrent is still active.
+func (tc *TorrentClient) addFileProgress(status *ExtractStatus, logFileName string) {
+	m := extractionLogPattern.FindStringSubmatch(logFileName)
+	if m == nil {
+		return
+	}
+	val, found := tc.cache.Peek(m[1])
+	if !found {
+		return
+	}
+	t := val.(*cacheEntry).torrent
+	if t.Info() == nil {
+		return
+	}
+	index, _ := strconv.Atoi(m[2])
+	file := tc.getFileToStream(t, index)
+	if file == nil {
+		return
+	}
+	status.FileBytesCompleted = file.BytesCompleted()
+	status.FileBytesRemaining = file.Length() - status.FileBytesCompleted
+	status.FileBytesRemainingHuman = humanReadableSize(status.FileBytesRemaining)
+}
+
+// hmsToSeconds converts the hour, minute and second groups of an ffmpeg timestamp to seconds.
+func hmsToSeconds(h, m, sec string) float64 {
+	hours, _ := strconv.ParseFloat(h, 64)
+	minutes, _ := strconv.ParseFloat(m, 64)
+	seconds, _ := strconv.ParseFloat(sec, 64)
+	return hours*3600 + minutes*60 + seconds
+}
+
+// lastLogLine returns the last non-empty line of an ffmpeg log, treating \r as a line break.
+func lastLogLine(logText string) string {
+	lines := strings.FieldsFunc(logText, func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// readLogTail reads at most extractLogTailSize bytes from the end of the file at path,
+// plus the head of the file when it was skipped, since ffmpeg prints the input
+// duration before any progress.
+func readLogTail(path string) (head, tail string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if info.Size() <= extractLogTailSize {
+		data, err := io.ReadAll(f)
+		return "", string(data), err
+	}
+	headBuf := make([]byte, extractLogTailSize)
+	n, err := io.ReadFull(f, headBuf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", "", err
+	}
+	tailBuf := make([]byte, extractLogTailSize)
+	m, err := f.ReadAt(tailBuf, info.Size()-extractLogTailSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", "", err
+	}
+	return string(headBuf[:n]), string(tailBuf[:m]), nil
+}
+
+// parseExtractLog builds an ExtractStatus from the head and tail of an ffmpeg log.
+func parseExtractLog(head, tail string, running bool) ExtractStatus {
+	status := ExtractStatus{Running: running}
+	if match := ffmpegDurationRegex.FindStringSubmatch(head + tail); match != nil {
+		status.DurationSeconds = hmsToSeconds(match[1], match[2], match[3])
+	}
+	if matches := ffmpegTimeRegex.FindAllStringSubmatch(tail, -1); len(matches) > 0 {
+		last := matches[len(matches)-1]
+		status.Time = strings.TrimSpace(strings.TrimPrefix(last[0], "time="))
+		status.PositionSeconds = hmsToSeconds(last[1], last[2], last[3])
+	}
+	if matches := ffmpegSizeRegex.FindAllStringSubmatch(tail, -1); len(matches) > 0 {
+		status.Size = matches[len(matches)-1][1]
+	}
+	if status.DurationSeconds > 0 {
+		status.Percent = min(100, status.PositionSeconds/status.DurationSeconds*100)
+	}
+
+	switch {
+	case strings.Contains(tail, "Extraction finished successfully"):
+		status.Status = "success"
+		status.Percent = 100
+	case strings.Contains(tail, "Extraction failed"):
+		status.Status = "failure"
+		status.Message = lastLogLine(tail)
+	case running:
+		status.Status = "running"
+	default:
+		// The log was left by an extraction that didn't finish, e.g. before a restart.
+		status.Status = "unknown"
+		status.Message = lastLogLine(tail)
+	}
+	return status
+}
+
+// extractStatusHandler reports the progress of a subtitle extraction started by
+// /extract-subtitles, parsed from its ffmpeg log.
+func (tc *TorrentClient) extractStatusHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("file")
+	if fileName == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'file' query parameter")
+		return
+	}
+	if !strings.HasSuffix(fileName, ".log") {
+		writeJSONError(w, http.StatusBadRequest, "'file' must be an extraction log file")
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	logFilePath, ok := extractionFilePath(dataDir, fileName)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Invalid file path")
+		return
+	}
+
+	tc.extractionsMu.Lock()
+	running := tc.extractions[fileName]
+	queuePosition := slices.Index(tc.extractionQueue, fileName) + 1
+	queueLength := len(tc.extractionQueue)
+	tc.extractionsMu.Unlock()
+
+	if queuePosition > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		status := ExtractStatus{Status: "queued", Running: true, QueuePosition: queuePosition, QueueLength: queueLength}
+		tc.addFileProgress(&status, fileName)
+		json.NewEncoder(w).Encode(status)
+		return
+	}
+
+	head, tail, err := readLogTail(logFilePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) && running {
+			// The extraction goroutine hasn't created its log yet.
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			status := ExtractStatus{Status: "running", Running: true}
+			tc.addFileProgress(&status, fileName)
+			json.NewEncoder(w).Encode(status)
+			return
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			writeJSONError(w, http.StatusNotFound, "Extraction log not found")
+			return
+		}
+		slog.Error("Error reading extraction log", "path", logFilePath, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "Failed to read extraction log")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	status := parseExtractLog(head, tail, running)
+	tc.addFileProgress(&status, fileName)
+	json.NewEncoder(w).Encode(status)
+}
+
+// extractLogPollInterval is how often /extract-logs checks an ffmpeg log for new output.
+const extractLogPollInterval = 500 * time.Millisecond
+
+// extractLogsHandler streams the lines appended to an extraction's ffmpeg log as
+// Server-Sent Events. Progress lines, which ffmpeg rewrites with \r, are sent as
+// separate events. Once the extraction has ended, a final "done" event carries
+// its status as JSON, and the stream ends.
+func (tc *TorrentClient) extractLogsHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := r.URL.Query().Get("file")
+	if fileName == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'file' query parameter")
+		return
+	}
+	if !strings.HasSuffix(fileName, ".log") {
+		writeJSONError(w, http.StatusBadRequest, "'file' must be an extraction log file")
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	logFilePath, ok := extractionFilePath(dataDir, fileName)
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "Invalid file path")
+		return
+	}
+	if _, err := os.Stat(logFilePath); errors.Is(err, os.ErrNotExist) && !tc.extractionActive(fileName) {
+		writeJSONError(w, http.StatusNotFound, "Extraction log not found")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep reverse proxies from buffering events
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.Warn("Event stream not supported by the connection", "err", err)
+		return
+	}
+
+	var logFile *os.File
+	defer func() {
+		if logFile != nil {
+			logFile.Close()
+		}
+	}()
+	ticker := time.NewTicker(extractLogPollInterval)
+	defer ticker.Stop()
+	buf := make([]byte, 32<<10)
+	var pending []byte
+	for {
+		// Checked before reading, so output written just before ffmpeg exited is
+		// still sent ahead of the done event.
+		active := tc.extractionActive(fileName)
+		if logFile == nil {
+			logFile, _ = os.Open(logFilePath) // Not created yet while queued; retried on the next tick
+		}
+		if logFile != nil {
+			for {
+				n, err := logFile.Read(buf)
+				pending = append(pending, buf[:n]...)
+				if n == 0 || err != nil {
+					break
+				}
+			}
+			for {
+				end := bytes.IndexAny(pending, "\r\n")
+				if end < 0 {
+					break
+				}
+				if line := strings.TrimSpace(string(pending[:end])); line != "" {
+					fmt.Fprintf(w, "data: %s\n\n", line)
+				}
+				pending = pending[end+1:]
+			}
+		}
+		if !active {
+			if line := strings.TrimSpace(string(pending)); line != "" {
+				fmt.Fprintf(w, "data: %s\n\n", line)
+			}
+			head, tail, _ := readLogTail(logFilePath)
+			status, _ := json.Marshal(parseExtractLog(head, tail, false))
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", status)
+			rc.Flush()
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			slog.Debug("Extraction log stream closed by client", "logFile", fileName)
+			return
+		case <-tc.ctx.Done():
+			return
+		}
+	}
+}
+
+// extractionActive reports whether the extraction writing logFileName is queued or running.
+func (tc *TorrentClient) extractionActive(logFileName string) bool {
+	tc.extractionsMu.Lock()
+	defer tc.extractionsMu.Unlock()
+	return tc.extractions[logFileName]
+}
+
+// maxTorrentFileSize caps how much of a remote .torrent file is read into memory.
+// Real .torrent files are tiny.
+const maxTorrentFileSize = 10 << 20
+
+// errBlockedAddress is returned when a fetch would connect to a private, loopback
+// or link-local address.
+var errBlockedAddress = errors.New("address is not publicly routable")
+
+// cgnatRange is the carrier-grade NAT shared address space (RFC 6598).
+var cgnatRange = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	return ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified() && !cgnatRange.Contains(ip)
+}
+
+// validateFetchURL checks that a user-supplied URL is an absolute http(s) URL.
+func validateFetchURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q: only http and https are allowed", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+// newFetchClient returns the HTTP client used to download user-supplied .torrent
+// URLs. Unless allowPrivate is set, it refuses to connect to non-public addresses.
+// The check runs on the resolved address at dial time, so DNS names and redirects
+// pointing at internal hosts are rejected too.
+func newFetchClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment, MaxIdleConns: 10, IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if !allowPrivate {
+		// A proxy would make the dial-time check see the proxy's address instead of the target's.
+		transport.Proxy = nil
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicIP(net.ParseIP(host)) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, host)
+			}
+			return nil
+		}
+	}
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		Timeout:   60 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return validateFetchURL(req.URL.String())
+		},
+	}
+}
+
+type FetchTorrentURLRequest struct {
+	URL string `json:"url"`
+}
+
+func (tc *TorrentClient) fetchTorrentURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	var req FetchTorrentURLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	if err := validateFetchURL(req.URL); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	slog.Info("Fetching .torrent URL", "url", req.URL)
+	resp, err := tc.fetchClient.Get(req.URL)
+	if err != nil {
+		slog.Warn("Error fetching URL", "url", req.URL, "err", err)
+		if errors.Is(err, errBlockedAddress) {
+			writeJSONError(w, http.StatusForbidden, "Fetching from private or local network addresses is not allowed")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to fetch URL: %v", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	slog.Debug("Fetched URL", "url", req.URL, "status", resp.Status, "contentType", resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Non-OK status code for URL", "url", req.URL, "status", resp.Status)
+		writeJSONError(w, resp.StatusCode, fmt.Sprintf("Failed to fetch .torrent file from URL: %s", resp.Status))
+		return
+	}
+
+	torrentBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentFileSize+1))
+	if err != nil {
+		slog.Warn("Error reading .torrent content", "url", req.URL, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read .torrent content: %v", err))
+		return
+	}
+	if len(torrentBytes) > maxTorrentFileSize {
+		slog.Warn("Remote .torrent file is too large", "url", req.URL, "limit", maxTorrentFileSize)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Remote .torrent file is larger than %s", humanReadableSize(maxTorrentFileSize)))
+		return
+	}
+
+	slog.Debug("Read .torrent file", "url", req.URL, "bytes", len(torrentBytes))
+	mi, err := metainfo.Load(bytes.NewReader(torrentBytes))
+	if err != nil {
+		slog.Warn("Error parsing .torrent file", "url", req.URL, "err", err)
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse .torrent file from URL: %v", err))
+		return
+	}
+
+	magnetLink := mi.Magnet(nil, nil).String()
+	slog.Info("Generated magnet link for .torrent URL", "url", req.URL, "magnet", magnetLink)
+
+	response := map[string]string{"magnetLink": magnetLink}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ValidateResult describes a magnet link or .torrent file checked by /validate.
+// File details are only known for .torrent files, which carry the info.
+type ValidateResult struct {
+	Type           string   `json:"type"` // "magnet" or "torrent"
+	InfoHash       string   `json:"infoHash,omitempty"`
+	InfoHashV2     string   `json:"infoHashV2,omitempty"`
+	Name           string   `json:"name,omitempty"`
+	Trackers       []string `json:"trackers"`
+	FileCount      int      `json:"fileCount,omitempty"`
+	TotalSize      int64    `json:"totalSize,omitempty"`
+	TotalSizeHuman string   `json:"totalSizeHuman,omitempty"`
+}
+
+// validateHandler parses a magnet link (the 'url' query parameter) or a .torrent
+// file (the request body) and reports what it contains, without adding it to the
+// client or touching the database.
+func (tc *TorrentClient) validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+
+	var result ValidateResult
+	if raw := r.URL.Query().Get("url"); raw != "" {
+		magnetLink, err := normalizeMagnetLink(raw)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		m, err := metainfo.ParseMagnetV2Uri(magnetLink)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid magnet link: %v", err))
+			return
+		}
+		result = ValidateResult{Type: "magnet", Name: m.DisplayName, Trackers: m.Trackers}
+		if m.InfoHash.Ok {
+			result.InfoHash = m.InfoHash.Value.HexString()
+		}
+		if m.V2InfoHash.Ok {
+			result.InfoHashV2 = m.V2InfoHash.Value.HexString()
+		}
+	} else {
+		torrentBytes, err := io.ReadAll(io.LimitReader(r.Body, maxTorrentFileSize+1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to read request body: %v", err))
+			return
+		}
+		if len(torrentBytes) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "Provide a magnet link in the 'url' query parameter or a .torrent file as the request body")
+			return
+		}
+		if len(torrentBytes) > maxTorrentFileSize {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf(".torrent file is larger than %s", humanReadableSize(maxTorrentFileSize)))
+			return
+		}
+		mi, err := metainfo.Load(bytes.NewReader(torrentBytes))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Failed to parse .torrent file: %v", err))
+			return
+		}
+		info, err := mi.UnmarshalInfo()
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Invalid info dictionary in .torrent file: %v", err))
+			return
+		}
+		result = ValidateResult{Type: "torrent", Name: info.BestName(), FileCount: len(info.UpvertedFiles()), TotalSize: info.TotalLength()}
+		if info.HasV1() {
+			result.InfoHash = mi.HashInfoBytes().HexString()
+		}
+		if info.HasV2() {
+			v2 := infohash_v2.HashBytes(mi.InfoBytes)
+			result.InfoHashV2 = v2.HexString()
+		}
+		for _, tier := range mi.UpvertedAnnounceList() {
+			result.Trackers = appendUniqueTrackers(result.Trackers, tier...)
+		}
+		result.TotalSizeHuman = humanReadableSize(result.TotalSize)
+	}
+	if result.Trackers == nil {
+		result.Trackers = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
+
+// --- Indexer Search (Torznab) ---
+
+// SearchResult is a normalized search hit returned by /search.
+type SearchResult struct {
+	Title      string `json:"title"`
+	Size       int64  `json:"size"`
+	SizeHuman  string `json:"size_human"`
+	Seeders    int    `json:"seeders"`
+	Peers      int    `json:"peers"`
+	MagnetLink string `json:"magnetLink,omitempty"`
+	TorrentURL string `json:"torrentUrl,omitempty"` // Set when the indexer only offers a .torrent download
+}
+
+type torznabAttr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type torznabItem struct {
+	Title     string `xml:"title"`
+	Link      string `xml:"link"`
+	Size      int64  `xml:"size"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length int64  `xml:"length,attr"`
+	} `xml:"enclosure"`
+	Attrs []torznabAttr `xml:"attr"`
+}
+
+type torznabFeed struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []torznabItem `xml:"item"`
+	} `xml:"channel"`
+	// Populated when the indexer replies with <error code="..." description="..."/>.
+	Code        string `xml:"code,attr"`
+	Description string `xml:"description,attr"`
+}
+
+// toSearchResult normalizes a Torznab item, preferring a magnet link over a .torrent URL.
+func (item torznabItem) toSearchResult() SearchResult {
+	res := SearchResult{Title: item.Title, Size: item.Size}
+	if res.Size == 0 {
+		res.Size = item.Enclosure.Length
+	}
+	for _, attr := range item.Attrs {
+		switch attr.Name {
+		case "seeders":
+			res.Seeders, _ = strconv.Atoi(attr.Value)
+		case "peers":
+			res.Peers, _ = strconv.Atoi(attr.Value)
+		case "size":
+			if res.Size == 0 {
+				res.Size, _ = strconv.ParseInt(attr.Value, 10, 64)
+			}
+		case "magneturl":
+			res.MagnetLink = attr.Value
+		}
+	}
+	for _, link := range []string{item.Link, item.Enclosure.URL} {
+		if res.MagnetLink == "" && strings.HasPrefix(link, "magnet:") {
+			res.MagnetLink = link
+		}
+	}
+	if res.MagnetLink == "" {
+		if item.Enclosure.URL != "" {
+			res.TorrentURL = item.Enclosure.URL
+		} else {
+			res.TorrentURL = item.Link
+		}
+	}
+	res.SizeHuman = humanReadableSize(res.Size)
+	return res
+}
+
+// torznabSearchURL builds the Torznab search URL for the configured indexer.
+// The base URL may point either at the Torznab root or directly at its /api path.
+func (tc *TorrentClient) torznabSearchURL(query string) (string, error) {
+	u, err := url.Parse(tc.indexerURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid indexer URL: %w", err)
+	}
+	if !strings.HasSuffix(u.Path, "/api") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api"
+	}
+	q := u.Query()
+	q.Set("t", "search")
+	q.Set("q", query)
+	if tc.indexerAPIKey != "" {
+		q.Set("apikey", tc.indexerAPIKey)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (tc *TorrentClient) searchHandler(w http.ResponseWriter, r *http.Request) {
+	if tc.indexerURL == "" {
+		writeJSONError(w, http.StatusServiceUnavailable, "Search is not configured. Start the server with -indexer-url to enable it.")
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		writeJSONError(w, http.StatusBadRequest, "Missing 'q' query parameter")
+		return
+	}
+
+	searchURL, err := tc.torznabSearchURL(query)
+	if err != nil {
+		slog.Error("Error building indexer search URL", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, searchURL, nil)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to build indexer request: %v", err))
+		return
+	}
+	slog.Info("Searching indexer", "query", query)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Error("Error querying indexer", "query", query, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to reach the indexer")
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Indexer returned non-OK status", "query", query, "status", resp.Status)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Indexer returned %s", resp.Status))
+		return
+	}
+
+	var feed torznabFeed
+	if err := xml.NewDecoder(io.LimitReader(resp.Body, 10<<20)).Decode(&feed); err != nil {
+		slog.Error("Error parsing indexer response", "query", query, "err", err)
+		writeJSONError(w, http.StatusBadGateway, "Failed to parse indexer response")
+		return
+	}
+	if feed.XMLName.Local == "error" {
+		slog.Error("Indexer error", "query", query, "code", feed.Code, "description", feed.Description)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("Indexer error: %s", feed.Description))
+		return
+	}
+
+	results := make([]SearchResult, 0, len(feed.Channel.Items))
+	for _, item := range feed.Channel.Items {
+		results = append(results, item.toSearchResult())
+	}
+	slog.Info("Indexer search finished", "query", query, "results", len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"query": query, "results": results})
+}
+
+func (tc *TorrentClient) filesHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	// Browsing only needs the info; don't make the torrent active.
+	info, infoHash, err := tc.getTorrentInfo(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !requireFiles(w, info) {
+		return
+	}
+	files := info.UpvertedFiles()
+	var fileList []FileInfo
+	suggested := -1 // The largest streamable file, so a UI can skip samples and .nfo files
+	for i, file := range files {
+		displayPath := file.DisplayPath(info)
+		isSubtitle := strings.HasSuffix(strings.ToLower(displayPath), ".srt")
+		streamable := isVideoFile(displayPath)
+		if streamable && (suggested < 0 || file.Length > files[suggested].Length) {
+			suggested = i
+		}
+		fileList = append(fileList, FileInfo{Path: displayPath, Size: file.Length, SizeHuman: humanReadableSize(file.Length), IsSubtitle: isSubtitle, Streamable: streamable})
+	}
+	response := struct {
+		InfoHash           string
+		Files              []FileInfo
+		SuggestedMainIndex int `json:"suggestedMainIndex"`
+	}{InfoHash: infoHash, Files: fileList, SuggestedMainIndex: suggested}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (tc *TorrentClient) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	info, infoHash, err := tc.getTorrentInfo(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !requireFiles(w, info) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadataFromInfo(info, infoHash))
+}
+
+// PendingTorrent is returned for a torrent that was added but whose metadata
+// hasn't arrived yet: by /add with async=true, and by /status while it's fetched.
+type PendingTorrent struct {
+	InfoHash string `json:"infoHash"`
+	Status   string `json:"status"` // Always "fetchingMetadata"
+}
+
+// addHandler adds a torrent without streaming it, so a UI can warm it up in
+// advance. It waits for the torrent's info like /stream does and returns its
+// metadata; with async=true it returns 202 right away and the client polls /status.
+func (tc *TorrentClient) addHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	infoHash, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	trackers := requestTrackers(r)
+
+	if r.URL.Query().Get("async") == "true" {
+		go func() {
+			if _, err := tc.getTorrentFromMagnet(magnetLink, dataDir, trackers...); err != nil {
+				slog.Warn("Error adding torrent", "infoHash", infoHash, "err", err)
+			}
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(PendingTorrent{InfoHash: infoHash, Status: "fetchingMetadata"})
+		return
+	}
+
+	t, err := tc.getTorrentFromMagnet(magnetLink, dataDir, trackers...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadataFromInfo(t.Info(), t.InfoHash().HexString()))
+}
+
+func metadataFromInfo(info *metainfo.Info, infoHash string) Metadata {
+	totalSize := info.TotalLength()
+	return Metadata{Name: info.BestName(), InfoHash: infoHash, TotalSize: totalSize, TotalSizeHuman: humanReadableSize(totalSize), FileCount: len(info.UpvertedFiles())}
+}
+
+// Limits for /metadata/batch.
+const (
+	maxBatchMagnets      = 50
+	maxBatchBodySize     = 1 << 20 // Room for maxBatchMagnets magnets with long tracker lists
+	batchMetadataWorkers = 4
+)
+
+// BatchMetadataResult is one element of the /metadata/batch response, in request
+// order. Exactly one of Metadata and Error is set.
+type BatchMetadataResult struct {
+	URL      string    `json:"url"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// batchMetadataHandler resolves the metadata of several magnet links at once,
+// fetching them concurrently with a bounded number of workers. Items that fail or
+// time out carry an error while the others still return their metadata.
+func (tc *TorrentClient) batchMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	var magnets []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodySize)).Decode(&magnets); err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %s", humanReadableSize(maxBatchBodySize)))
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body: expected a JSON array of magnet links")
+		return
+	}
+	if len(magnets) > maxBatchMagnets {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("Too many magnet links (maximum %d)", maxBatchMagnets))
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	trackers := requestTrackers(r)
+
+	results := make([]BatchMetadataResult, len(magnets))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchMetadataWorkers, len(magnets)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = tc.batchMetadataItem(magnets[i], dataDir, trackers)
+			}
+		}()
+	}
+	// Stop handing out items once the client is gone; those already being
+	// fetched finish in the background.
+	ctx := r.Context()
+feed:
+	for i := range magnets {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	if ctx.Err() != nil {
+		slog.Info("Batch metadata request canceled by the client", "magnets", len(magnets))
+		return
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (tc *TorrentClient) batchMetadataItem(raw, dataDir string, trackers []string) BatchMetadataResult {
+	result := BatchMetadataResult{URL: raw}
+	magnetLink, err := normalizeMagnetLink(raw)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	info, infoHash, err := tc.getTorrentInfo(magnetLink, dataDir, trackers...)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if infoFileCount(info) == 0 {
+		result.Error = errNoFiles.Error()
+		return result
+	}
+	metadata := metadataFromInfo(info, infoHash)
+	result.Metadata = &metadata
+	return result
+}
+
+// requestBaseURL returns the scheme and host the client used to reach the server,
+// for building absolute URLs to hand to external players.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// playlistHandler returns an M3U playlist of the video files in a torrent, in
+// path order, so a whole season can be opened in VLC or mpv at once.
+func (tc *TorrentClient) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
+		return
+	}
+	// The playlist only lists files; the player's /stream requests activate the torrent.
+	info, _, err := tc.getTorrentInfo(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, torrentErrorStatus(err), err.Error())
+		return
+	}
+	if !requireFiles(w, info) {
+		return
+	}
+
+	files := info.UpvertedFiles()
+	indexes := []int{}
+	for i, file := range files {
+		if isVideoFile(file.DisplayPath(info)) {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		writeJSONError(w, http.StatusUnprocessableEntity, "torrent contains no video files")
+		return
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return files[indexes[a]].DisplayPath(info) < files[indexes[b]].DisplayPath(info)
+	})
+
+	// External players can't send the auth cookie, so pass a query token along.
+	tokenParam := ""
+	if token := r.URL.Query().Get("access_token"); token != "" {
+		tokenParam = "&access_token=" + url.QueryEscape(token)
+	}
+	baseURL := requestBaseURL(r)
+	var playlist strings.Builder
+	playlist.WriteString("#EXTM3U\n")
+	for _, i := range indexes {
+		file := files[i]
+		// Duration is unknown up front; -1 is the M3U convention for that.
+		fmt.Fprintf(&playlist, "#EXTINF:-1,%s\n", strings.ReplaceAll(file.DisplayPath(info), "\n", " "))
+		fmt.Fprintf(&playlist, "%s/stream?url=%s&index=%d%s\n", baseURL, url.QueryEscape(magnetLink), i, tokenParam)
+	}
+
+	filename := sanitize(info.BestName()) + ".m3u"
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	io.WriteString(w, playlist.String())
+}
+
+func (tc *TorrentClient) statusHandler(w http.ResponseWriter, r *http.Request) {
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	peers, err := requestPeers(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	infoHashStr, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	val, found := tc.cache.Get(infoHashStr)
+	if !found {
+		// A torrent added by /add?async=true joins the cache once its info arrives.
+		if t, ok := tc.client.Torrent(metainfo.NewHashFromHex(infoHashStr)); ok && t.Info() == nil {
+			addRequestPeers(t, peers)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(PendingTorrent{InfoHash: infoHashStr, Status: "fetchingMetadata"})
+			return
+		}
+		writeJSONError(w, http.StatusNotFound, "Torrent not found or not active")
+		return
+	}
+
+	cachedEntry := val.(*cacheEntry)
+	t := cachedEntry.torrent
+	addRequestPeers(t, peers)
+	<-t.GotInfo()
+	if !requireFiles(w, t.Info()) {
+		return
+	}
+
+	var streamingFileSize int64
+	var streamingFileSizeHuman string
+
+	if r.URL.Query().Get("path") != "" || r.URL.Query().Get("index") != "" {
+		if streamingFile, _, err := tc.requestedFile(t, r); err == nil {
+			streamingFileSize = streamingFile.Length()
+			streamingFileSizeHuman = humanReadableSize(streamingFileSize)
+		}
+	}
+
+	var fileStatuses []FileStatus
+	for _, file := range t.Files() {
+		fileSize := file.Length()
+		bytesCompleted := file.BytesCompleted()
+		percentage := 0.0
+		if fileSize > 0 {
+			percentage = float64(bytesCompleted) / float64(fileSize) * 100
+		}
+		fileStatuses = append(fileStatuses, FileStatus{Path: file.DisplayPath(), Size: fileSize, BytesCompleted: bytesCompleted, PercentageCompleted: percentage})
+	}
+	totalBytes := t.Info().TotalLength()
+	bytesCompleted := t.BytesCompleted()
+
+	now := time.Now()
+
+	cachedEntry.mu.Lock()
+	timeDelta := now.Sub(cachedEntry.prevReadTime).Seconds()
+	if timeDelta > 0.5 { // Only update speed every half second to avoid noisy data
+		byteDelta := bytesCompleted - cachedEntry.prevBytesRead
+		cachedEntry.lastSpeed = float64(byteDelta) / timeDelta
+
+		// Per-file speeds use the same window. The first sample has no baseline.
+		hasFileBaseline := len(cachedEntry.prevFileBytes) == len(fileStatuses)
+		if !hasFileBaseline {
+			cachedEntry.prevFileBytes = make([]int64, len(fileStatuses))
+		}
+		if len(cachedEntry.lastFileSpeeds) != len(fileStatuses) {
+			cachedEntry.lastFileSpeeds = make([]float64, len(fileStatuses))
+		}
+		for i := range fileStatuses {
+			if hasFileBaseline {
+				cachedEntry.lastFileSpeeds[i] = float64(fileStatuses[i].BytesCompleted-cachedEntry.prevFileBytes[i]) / timeDelta
+			}
+			cachedEntry.prevFileBytes[i] = fileStatuses[i].BytesCompleted
+		}
+
+		cachedEntry.prevBytesRead = bytesCompleted
+		cachedEntry.prevReadTime = now
+	}
+	// Inside the sampling window, report the last computed speeds rather than 0.
+	downloadSpeed := cachedEntry.lastSpeed
+	for i := range fileStatuses {
+		if i < len(cachedEntry.lastFileSpeeds) {
+			fileStatuses[i].DownloadSpeedBps = cachedEntry.lastFileSpeeds[i]
+		}
+		fileStatuses[i].DownloadSpeedHuman = humanReadableSpeed(fileStatuses[i].DownloadSpeedBps)
+	}
+	verifying := cachedEntry.verifying
+	verifyPercent := 0.0
+	if verifying && t.NumPieces() > 0 {
+		verifyPercent = float64(cachedEntry.verifiedPieces) / float64(t.NumPieces()) * 100
+	}
+	paused := cachedEntry.paused
+	cachedEntry.mu.Unlock()
+
+	percentageCompleted := 0.0
+	if totalBytes > 0 {
+		percentageCompleted = float64(bytesCompleted) / float64(totalBytes) * 100
+	}
+
+	stats := t.Stats()
+	downloaded := stats.BytesReadData.Int64()
+	uploaded := stats.BytesWrittenData.Int64()
+	response := StatusInfo{
+		InfoHash:               t.InfoHash().HexString(),
+		Name:                   t.Name(),
+		TotalBytes:             totalBytes,
+		BytesCompleted:         bytesCompleted,
+		PercentageCompleted:    percentageCompleted,
+		DownloadSpeedBps:       downloadSpeed,
+		DownloadSpeedHuman:     humanReadableSpeed(downloadSpeed),
+		ConnectedPeers:         stats.ActivePeers,
+		PeersTotal:             stats.TotalPeers,
+		DownloadedBytes:        downloaded,
+		DownloadedHuman:        humanReadableSize(downloaded),
+		UploadedBytes:          uploaded,
+		UploadedHuman:          humanReadableSize(uploaded),
+		Files:                  fileStatuses,
+		StreamingFileSize:      streamingFileSize,
+		StreamingFileSizeHuman: streamingFileSizeHuman,
+		Verifying:              verifying,
+		VerifyPercent:          verifyPercent,
+		Paused:                 paused,
+	}
+	if r.URL.Query().Get("pieces") == "true" {
+		response.NumPieces = t.NumPieces()
+		response.PieceLength = t.Info().PieceLength
+		response.Pieces = pieceBitfield(t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// pieceBitfield encodes which pieces of t are complete as standard base64 of a
+// bitfield laid out like the BitTorrent protocol's: piece i is bit 7-(i%8) of
+// byte i/8, so the first piece is the high bit of the first byte, and spare bits
+// in the last byte are zero.
+func pieceBitfield(t *torrent.Torrent) string {
+	bits := make([]byte, (t.NumPieces()+7)/8)
+	for i := 0; i < t.NumPieces(); i++ {
+		if t.PieceState(i).Complete {
+			bits[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(bits)
+}
+
+// --- Pause/Resume ---
+
+func (tc *TorrentClient) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	tc.setPaused(w, r, true)
+}
+
+func (tc *TorrentClient) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	tc.setPaused(w, r, false)
+}
+
+// setPaused stops or restarts data download for an active torrent while keeping it
+// in the cache. Pausing drops every file to PiecePriorityNone and disallows data
+// download, so pieces wanted by open stream readers stop too; resuming restores the
+// previous file priorities.
+func (tc *TorrentClient) setPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
+		return
+	}
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	infoHash, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	val, found := tc.cache.Get(infoHash)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Torrent not found or not active")
+		return
+	}
+	entry := val.(*cacheEntry)
+	t := entry.torrent
+	<-t.GotInfo()
+
+	entry.mu.Lock()
+	if paused && !entry.paused {
+		entry.pausedPriorities = make([]torrent.PiecePriority, len(t.Files()))
+		for i, file := range t.Files() {
+			entry.pausedPriorities[i] = file.Priority()
+			file.SetPriority(torrent.PiecePriorityNone)
+		}
+		t.DisallowDataDownload()
+		slog.Info("Paused torrent", "infoHash", infoHash, "name", t.Name())
+	} else if !paused && entry.paused {
+		for i, file := range t.Files() {
+			if i < len(entry.pausedPriorities) {
+				file.SetPriority(entry.pausedPriorities[i])
+			}
+		}
+		entry.pausedPriorities = nil
+		t.AllowDataDownload()
+		slog.Info("Resumed torrent", "infoHash", infoHash, "name", t.Name())
+	}
+	entry.paused = paused
+	entry.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"infoHash": infoHash, "paused": paused})
+}
+
+// --- Purge ---
+
+type PurgeFile struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	SizeHuman string `json:"size_human"`
+}
+
+type PurgeResult struct {
+	InfoHash       string      `json:"infoHash"`
+	DryRun         bool        `json:"dryRun"`
+	Files          []PurgeFile `json:"files"`
+	TotalSize      int64       `json:"totalSize"`
+	TotalSizeHuman string      `json:"totalSize_human"`
+}
+
+// torrentDataPaths returns where file storage keeps each file of a torrent in
+// dataDir: <dataDir>/<name> for single-file torrents and <dataDir>/<name>/<path>
+// for multi-file ones. Incomplete files carry a ".part" suffix, so both names are
+// returned. Paths that would escape the download directory are skipped.
+func (tc *TorrentClient) torrentDataPaths(info *metainfo.Info, dataDir string) []string {
+	var paths []string
+	for _, fi := range info.UpvertedFiles() {
+		var comps []string
+		if info.BestName() != metainfo.NoName {
+			comps = append(comps, info.BestName())
+		}
+		rel, err := storage.ToSafeFilePath(append(comps, fi.BestPath()...)...)
+		if err != nil {
+			slog.Warn("Skipping unsafe torrent file path", "name", info.BestName(), "err", err)
+			continue
+		}
+		filePath := filepath.Join(dataDir, rel)
+		if r, err := filepath.Rel(tc.downloadDir, filePath); err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			slog.Warn("Skipping torrent file outside the download directory", "path", filePath)
+			continue
+		}
+		paths = append(paths, filePath, filePath+".part")
+	}
+	return paths
+}
+
+// purgeHandler drops a torrent and deletes its data from disk. With dryRun=true it
+// only reports the files that would be deleted.
+func (tc *TorrentClient) purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
 		return
 	}
+	magnetLink, ok := magnetParam(w, r)
+	if !ok {
+		return
+	}
+	dryRun := r.URL.Query().Get("dryRun") == "true"
 
-	// Write VTT content to file
-	if err := os.WriteFile(vttFilePath, []byte(vttContent), 0644); err != nil {
-		log.Printf("Error writing VTT file %s: %v", vttFilePath, err)
-		http.Error(w, "Failed to save VTT file", http.StatusInternalServerError)
+	// An active torrent's data lives where it was added; otherwise use the
+	// directory this request would have stored it in.
+	dataDir, ok := tc.requestDataDir(w, r)
+	if !ok {
 		return
 	}
-	log.Printf("downloadSubtitleHandler: Successfully wrote new VTT file to %s. Adding to vttFileMap.", vttFilePath)
+	info, infoHash, err := tc.getTorrentInfo(magnetLink, dataDir, requestTrackers(r)...)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, fmt.Sprintf("Error getting torrent info: %v", err))
+		return
+	}
+	if val, found := tc.cache.Peek(infoHash); found {
+		dataDir = val.(*cacheEntry).dataDir
+	}
 
-	// Store VTT filename (key) to full path mapping
-	tc.vttFileMapMu.Lock()
-	tc.vttFileMap[vttFilename] = vttFilePath
-	tc.vttFileMapMu.Unlock()
+	files, existing, totalSize := tc.dataOnDisk(info, dataDir)
+	result := PurgeResult{InfoHash: infoHash, DryRun: dryRun, Files: files, TotalSize: totalSize, TotalSizeHuman: humanReadableSize(totalSize)}
+
+	if !dryRun {
+		tc.purgeTorrent(infoHash, info, dataDir, existing)
+		slog.Info("Purged torrent data", "infoHash", infoHash, "name", info.BestName(), "files", len(existing), "size", result.TotalSizeHuman)
+	}
 
-	// Respond with the VTT filename (which acts as the key for streamVttHandler)
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"vttKey": vttFilename})
+	json.NewEncoder(w).Encode(result)
 }
 
-func (tc *TorrentClient) streamVttHandler(w http.ResponseWriter, r *http.Request) {
-	vttFilename := r.URL.Query().Get("key")
-	log.Printf("streamVttHandler: Received request for VTT key: %s", vttFilename)
-	if vttFilename == "" {
-		http.Error(w, "Missing 'key' query parameter (VTT filename)", http.StatusBadRequest)
-		return
+// dataOnDisk returns the files of a torrent that exist in dataDir, both for the
+// API and as paths, and their total size.
+func (tc *TorrentClient) dataOnDisk(info *metainfo.Info, dataDir string) (files []PurgeFile, paths []string, totalSize int64) {
+	files = []PurgeFile{}
+	for _, path := range tc.torrentDataPaths(info, dataDir) {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		rel, _ := filepath.Rel(tc.downloadDir, path)
+		files = append(files, PurgeFile{Path: filepath.ToSlash(rel), Size: fi.Size(), SizeHuman: humanReadableSize(fi.Size())})
+		totalSize += fi.Size()
+		paths = append(paths, path)
 	}
+	return files, paths, totalSize
+}
 
-	tc.vttFileMapMu.Lock()
-	vttFilePath, found := tc.vttFileMap[vttFilename]
-	tc.vttFileMapMu.Unlock()
+// purgeTorrent drops a torrent with its metadata and deletes its data files,
+// as listed by dataOnDisk.
+func (tc *TorrentClient) purgeTorrent(infoHash string, info *metainfo.Info, dataDir string, paths []string) {
+	// Removing the cache entry drops the torrent and its subtitle files; a
+	// torrent still fetching info outside the cache is dropped directly.
+	tc.cache.Remove(infoHash)
+	if t, ok := tc.client.Torrent(metainfo.NewHashFromHex(infoHash)); ok {
+		t.Drop()
+	}
+	tc.deleteMetainfo(infoHash)
+	tc.saveSession()
+	tc.deleteTorrentData(infoHash, info, dataDir, paths)
+}
 
-	if !found {
-		log.Printf("streamVttHandler: VTT file with key %s not found in vttFileMap.", vttFilename)
-		http.Error(w, "VTT file not found or no longer active", http.StatusNotFound)
-		return
+// deleteTorrentData deletes a dropped torrent's data files, as listed by
+// dataOnDisk, and the directories they leave empty.
+func (tc *TorrentClient) deleteTorrentData(infoHash string, info *metainfo.Info, dataDir string, paths []string) {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Error deleting torrent data", "infoHash", infoHash, "path", path, "err", err)
+		}
 	}
-	log.Printf("streamVttHandler: Found VTT file with key %s at path %s.", vttFilename, vttFilePath)
+	if info.IsDir() {
+		tc.removeEmptyDirs(filepath.Join(dataDir, info.BestName()))
+	}
+}
 
-	vttContent, err := os.ReadFile(vttFilePath)
-	if err != nil {
-		log.Printf("Error reading VTT file %s: %v", vttFilePath, err)
-		http.Error(w, "Failed to read VTT file", http.StatusInternalServerError)
+// removeEmptyDirs removes root and any directories below it that are left empty,
+// deepest first. Directories outside the download directory are never touched.
+func (tc *TorrentClient) removeEmptyDirs(root string) {
+	if rel, err := filepath.Rel(tc.downloadDir, root); err != nil || rel == "." || strings.HasPrefix(rel, "..") {
 		return
 	}
-
-	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
-	w.Header().Set("Content-Length", strconv.Itoa(len(vttContent)))
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(vttContent); err != nil {
-		log.Printf("Error writing VTT content: %v", err)
+	var dirs []string
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i]) // Fails, harmlessly, if the directory isn't empty
 	}
 }
 
-func (tc *TorrentClient) extractSubtitlesHandler(w http.ResponseWriter, r *http.Request) {
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+type CacheClearResult struct {
+	Torrents        int    `json:"torrents"`        // Torrents dropped
+	MetadataEntries int    `json:"metadataEntries"` // Metainfo and alias entries deleted from LotusDB
+	FreedSize       int64  `json:"freedSize"`       // Bytes of torrent data deleted from disk
+	FreedSizeHuman  string `json:"freedSize_human"`
+}
+
+// cacheClearHandler drops every active torrent and its subtitle files. With
+// purgeMetadata=true it also deletes all persisted metainfo, and with
+// purgeData=true the torrents' data on disk.
+func (tc *TorrentClient) cacheClearHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
 		return
 	}
-	indexStr := r.URL.Query().Get("index")
-	index, err := strconv.Atoi(indexStr)
-	if err != nil {
-		http.Error(w, "Missing or invalid 'index' query parameter", http.StatusBadRequest)
-		return
+	purgeMetadata := r.URL.Query().Get("purgeMetadata") == "true"
+	purgeData := r.URL.Query().Get("purgeData") == "true"
+
+	var result CacheClearResult
+	for _, key := range tc.cache.Keys() {
+		val, ok := tc.cache.Peek(key)
+		infoHash, isString := key.(string)
+		if !ok || !isString {
+			continue
+		}
+		entry := val.(*cacheEntry)
+		info := entry.torrent.Info()
+		var paths []string
+		if purgeData && info != nil {
+			var size int64
+			_, paths, size = tc.dataOnDisk(info, entry.dataDir)
+			result.FreedSize += size
+		}
+		// Removing the cache entry drops the torrent and its subtitle files.
+		tc.cache.Remove(infoHash)
+		result.Torrents++
+		if len(paths) > 0 {
+			tc.deleteTorrentData(infoHash, info, entry.dataDir, paths)
+		}
+	}
+	// Torrents still fetching info aren't in the cache yet. Those an add or
+	// info-only fetch is waiting on are left to it, as dropUnlessInUse does.
+	tc.torrentUsesMu.Lock()
+	for _, t := range tc.client.Torrents() {
+		if !tc.torrentInUseLocked(t) {
+			t.Drop()
+		}
+	}
+	tc.torrentUsesMu.Unlock()
+	if purgeMetadata {
+		result.MetadataEntries = tc.deleteAllMetainfo()
 	}
+	tc.saveSession()
+	result.FreedSizeHuman = humanReadableSize(result.FreedSize)
+
+	slog.Info("Cleared torrent cache", "torrents", result.Torrents, "purgeMetadata", purgeMetadata, "metadataEntries", result.MetadataEntries, "purgeData", purgeData, "freed", result.FreedSizeHuman)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	spec, err := metainfo.ParseMagnetURI(magnetLink)
+// deleteAllMetainfo deletes every persisted metainfo and infohash alias from
+// LotusDB, leaving the session and VTT mappings, and returns how many entries
+// it deleted.
+func (tc *TorrentClient) deleteAllMetainfo() int {
+	if tc.db == nil {
+		return 0
+	}
+	iter, err := tc.db.NewIterator(lotusdb.IteratorOptions{})
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid magnet link: %v", err), http.StatusBadRequest)
-		return
+		slog.Error("Error iterating LotusDB", "err", err)
+		return 0
+	}
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := string(iter.Key())
+		if key == sessionKey || strings.HasPrefix(key, vttKeyPrefix) {
+			continue
+		}
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Close(); err != nil {
+		slog.Error("Error closing LotusDB iterator", "err", err)
 	}
-	infoHash := spec.InfoHash.HexString()
 
-	t, err := tc.getTorrentFromMagnet(magnetLink)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	deleted := 0
+	for _, key := range keys {
+		if err := tc.db.Delete(key); err != nil {
+			slog.Error("Failed to delete torrent metadata from LotusDB", "key", string(key), "err", err)
+			continue
+		}
+		deleted++
 	}
+	return deleted
+}
 
-	file := getFileToStream(t, index)
-	if file == nil {
-		http.Error(w, "Could not find the specified file in the torrent", http.StatusInternalServerError)
+func (tc *TorrentClient) Close() {
+	if tc.internalServer != nil {
+		tc.internalServer.Close()
+	}
+	tc.client.Close()
+	tc.sessionStoragesMu.Lock()
+	for dir, st := range tc.sessionStorages {
+		if err := st.Close(); err != nil {
+			slog.Error("Error closing session storage", "path", dir, "err", err)
+		}
+	}
+	clear(tc.sessionStorages)
+	tc.sessionStoragesMu.Unlock()
+	if tc.db == nil {
 		return
 	}
+	if err := tc.db.Close(); err != nil {
+		slog.Error("Error closing LotusDB", "err", err)
+	}
+}
 
-	inputStreamURL := fmt.Sprintf("http://localhost:%d/stream?url=%s&index=%d", tc.port, url.QueryEscape(magnetLink), index)
+// healthHandler is a lightweight liveness/readiness probe. It is served outside
+// the auth middleware so orchestrators can reach it without credentials.
+func (tc *TorrentClient) healthHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"status":   "ok",
+		"torrents": tc.cache.Len(),
+		"uptime":   time.Since(tc.startTime).Round(time.Second).String(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
 
-	subtitleFileName := fmt.Sprintf("%s_%d.ass", infoHash, index)
-	subtitleFilePath := filepath.Join(tc.downloadDir, subtitleFileName)
-	logFileName := fmt.Sprintf("%s_%d.log", infoHash, index)
-	logFilePath := filepath.Join(tc.downloadDir, logFileName)
+// Build information, injected at build time with e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Unset values fall back to what the Go toolchain embeds in the binary.
+var (
+	version   = ""
+	gitCommit = ""
+	buildDate = ""
+)
 
-	// Clean up old log file if it exists
-	os.Remove(logFilePath)
+// VersionInfo is the response of /version.
+type VersionInfo struct {
+	Version        string `json:"version"`
+	GitCommit      string `json:"gitCommit,omitempty"`
+	BuildDate      string `json:"buildDate,omitempty"`
+	TorrentVersion string `json:"torrentVersion,omitempty"` // github.com/anacrolix/torrent
+	GoVersion      string `json:"goVersion"`
+	OS             string `json:"os"`
+	Arch           string `json:"arch"`
+}
 
-	ffmpegPath, err := exec.LookPath("ffmpeg")
-	if err != nil {
-		log.Printf("ffmpeg executable not found in PATH: %v", err)
-		http.Error(w, "ffmpeg executable not found. Please ensure ffmpeg is installed and in your system's PATH.", http.StatusInternalServerError)
-		return
+func buildVersionInfo() VersionInfo {
+	info := VersionInfo{Version: version, GitCommit: gitCommit, BuildDate: buildDate,
+		GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.GitCommit == "":
+				info.GitCommit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == "github.com/anacrolix/torrent" {
+				info.TorrentVersion = dep.Version
+				if dep.Replace != nil {
+					info.TorrentVersion = dep.Replace.Version
+				}
+			}
+		}
 	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	return info
+}
 
-	cmd := exec.Command(ffmpegPath, "-y", "-i", inputStreamURL, "-map", "0:s:0", "-c", "copy", subtitleFilePath)
-
-	go func() {
-		log.Printf("Starting subtitle extraction for %s, index %d", t.Name(), index)
-		log.Printf("Executing command: %s", cmd.String())
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(buildVersionInfo())
+}
 
-		logFile, err := os.Create(logFilePath)
-		if err != nil {
-			log.Printf("Error creating log file for extraction: %v", err)
-			return
+// activePeerCount returns the number of connected peers across all cached torrents.
+func (tc *TorrentClient) activePeerCount() int {
+	peers := 0
+	for _, key := range tc.cache.Keys() {
+		if val, ok := tc.cache.Peek(key); ok {
+			peers += val.(*cacheEntry).torrent.Stats().ActivePeers
 		}
-		defer logFile.Close()
+	}
+	return peers
+}
 
-		cmd.Stderr = logFile
-		cmd.Stdout = logFile
+// ClientStats holds the client-wide session totals returned by /stats.
+type ClientStats struct {
+	BytesRead         int64  `json:"bytesRead"`
+	BytesReadHuman    string `json:"bytesReadHuman"`
+	BytesWritten      int64  `json:"bytesWritten"`
+	BytesWrittenHuman string `json:"bytesWrittenHuman"`
+	TorrentsAdded     int64  `json:"torrentsAdded"`
+	ActiveTorrents    int    `json:"activeTorrents"`
+	ConnectedPeers    int    `json:"connectedPeers"`
+	CacheHits         int64  `json:"cacheHits"`       // Served from the in-memory LRU cache
+	DBHits            int64  `json:"dbHits"`          // Loaded from metadata persisted in LotusDB
+	MagnetFetches     int64  `json:"magnetFetches"`   // Metadata fetched from the swarm
+	PersistFailures   int64  `json:"persistFailures"` // Metadata that couldn't be saved to LotusDB
+	BlocklistRanges   int    `json:"blocklistRanges"` // IP ranges loaded from -blocklist
+	BlockedPeers      int64  `json:"blockedPeers"`    // Peer addresses refused because they matched the blocklist
+}
 
-		        cmdErr := cmd.Run()
-				if cmdErr != nil {
-					log.Printf("Error during subtitle extraction: %v", cmdErr)
-					logFile.WriteString(fmt.Sprintf("\n\nExtraction failed: %v", cmdErr))
-				} else {
-					// Check if the file was created and has content
-					info, statErr := os.Stat(subtitleFilePath)
-					if statErr != nil || info.Size() == 0 {
-						log.Printf("Subtitle extraction seemed to succeed, but output file is missing or empty: %s", subtitleFilePath)
-						logFile.WriteString("\n\nExtraction failed: Output file is missing or empty.")
-					} else {
-						log.Printf("Subtitle extraction finished successfully for %s, index %d. Output: %s", t.Name(), index, subtitleFilePath)
-						logFile.WriteString("\n\nExtraction finished successfully.")
-					}
-				}	}()
+func (tc *TorrentClient) statsHandler(w http.ResponseWriter, r *http.Request) {
+	clientStats := tc.client.Stats()
+	stats := ClientStats{
+		BytesRead:       clientStats.BytesReadData.Int64(),
+		BytesWritten:    clientStats.BytesWrittenData.Int64(),
+		TorrentsAdded:   tc.torrentsAdded.Load(),
+		ActiveTorrents:  tc.cache.Len(),
+		ConnectedPeers:  tc.activePeerCount(),
+		CacheHits:       tc.cacheHits.Load(),
+		DBHits:          tc.dbHits.Load(),
+		MagnetFetches:   tc.magnetFetches.Load(),
+		PersistFailures: tc.persistFailures.Load(),
+	}
+	if tc.blocklist != nil {
+		stats.BlocklistRanges = tc.blocklist.NumRanges()
+		stats.BlockedPeers = tc.blocklist.blocked.Load()
+	}
+	stats.BytesReadHuman = humanReadableSize(stats.BytesRead)
+	stats.BytesWrittenHuman = humanReadableSize(stats.BytesWritten)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(stats)
+}
 
-	response := map[string]string{
-		"logFile":      logFileName,
-		"subtitleFile": subtitleFileName,
+// ServerConfig describes the active runtime configuration returned by /config.
+type ServerConfig struct {
+	HTTPPort                    int      `json:"httpPort"`
+	TorrentListenPort           int      `json:"torrentListenPort"`
+	TorrentListenAddrs          []string `json:"torrentListenAddrs"`
+	SubtitleExtractionAvailable bool     `json:"subtitleExtractionAvailable"`
+	SearchEnabled               bool     `json:"searchEnabled"`
+	TranscodeEnabled            bool     `json:"transcodeEnabled"`
+	MaxDownloadRate             int64    `json:"maxDownloadRate"` // Bytes per second, 0 = unlimited
+	MaxUploadRate               int64    `json:"maxUploadRate"`   // Bytes per second, 0 = unlimited
+}
+
+func (tc *TorrentClient) configHandler(w http.ResponseWriter, r *http.Request) {
+	var listenAddrs []string
+	for _, addr := range tc.client.ListenAddrs() {
+		listenAddrs = append(listenAddrs, addr.Network()+"/"+addr.String())
+	}
+	response := ServerConfig{
+		HTTPPort:                    tc.port,
+		TorrentListenPort:           tc.client.LocalPort(),
+		TorrentListenAddrs:          listenAddrs,
+		SubtitleExtractionAvailable: tc.subtitleExtractionAvailable,
+		SearchEnabled:               tc.indexerURL != "",
+		TranscodeEnabled:            tc.transcodeEnabled && tc.subtitleExtractionAvailable,
+		MaxDownloadRate:             tc.maxDownloadRate,
+		MaxUploadRate:               tc.maxUploadRate,
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (tc *TorrentClient) serveSubtitleFileHandler(w http.ResponseWriter, r *http.Request) {
-	fileName := r.URL.Query().Get("file")
-	if fileName == "" {
-		http.Error(w, "Missing 'file' query parameter", http.StatusBadRequest)
-		return
+func (tc *TorrentClient) restartHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Info("Restart triggered via API")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "The server has been restarted.")
+	// Non-blocking send in case no one is listening.
+	select {
+	case tc.restartChan <- true:
+	default:
 	}
+}
 
-	filePath := filepath.Join(tc.downloadDir, fileName)
-
-	if !strings.HasPrefix(filepath.Clean(filePath), tc.downloadDir) {
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
+// shutdownHandler asks main to stop the server and exit. Like every other API
+// endpoint it requires the bearer token when -auth-token is set.
+func (tc *TorrentClient) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Only POST method is allowed")
 		return
 	}
-
-	http.ServeFile(w, r, filePath)
+	slog.Info("Shutdown triggered via API")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "The server is shutting down.")
+	select {
+	case tc.restartChan <- false:
+	default:
+	}
 }
 
+// --- DLNA/UPnP Media Server ---
 
+const (
+	ssdpMulticastAddr        = "239.255.255.250:1900"
+	ssdpMaxAge               = 1800
+	dlnaDeviceType           = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectoryType = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaDescriptionPath      = "/dlna/device.xml"
+)
 
+// newDLNAUUID returns a random (version 4) UUID identifying this media server.
+func newDLNAUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
 
-
-type FetchTorrentURLRequest struct {
-	URL string `json:"url"`
+// ssdpAdvertiser announces the media server on the LAN with SSDP and answers
+// M-SEARCH discovery requests from renderers such as smart TVs.
+type ssdpAdvertiser struct {
+	uuid     string
+	location string // URL of the device description
+	server   string // SERVER header value
+	conn     *net.UDPConn
+	group    *net.UDPAddr
 }
 
-func (tc *TorrentClient) fetchTorrentURLHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
+// startSSDP joins the SSDP multicast group and starts advertising location.
+func startSSDP(uuid, location string) (*ssdpAdvertiser, error) {
+	group, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddr)
+	if err != nil {
+		return nil, err
 	}
-
-	var req FetchTorrentURLRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join SSDP multicast group: %w", err)
 	}
+	a := &ssdpAdvertiser{uuid: uuid, location: location, conn: conn, group: group,
+		server: fmt.Sprintf("%s/1.0 UPnP/1.0 rsd93/1.0", runtime.GOOS)}
+	go a.serve()
+	go func() {
+		// Re-announce well within max-age so renderers keep the entry.
+		for {
+			a.notify("ssdp:alive")
+			time.Sleep(ssdpMaxAge / 4 * time.Second)
+		}
+	}()
+	slog.Info("DLNA media server advertised over SSDP", "location", location, "uuid", uuid)
+	return a, nil
+}
 
-	log.Printf("Attempting to fetch URL: %s", req.URL)
-	resp, err := http.Get(req.URL)
-	if err != nil {
-		log.Printf("Error fetching URL %s: %v", req.URL, err)
-		http.Error(w, fmt.Sprintf("Failed to fetch URL: %v", err), http.StatusInternalServerError)
-		return
+// notificationTypes returns the NT/ST values this device answers to.
+func (a *ssdpAdvertiser) notificationTypes() []string {
+	return []string{"upnp:rootdevice", "uuid:" + a.uuid, dlnaDeviceType, dlnaContentDirectoryType}
+}
+
+func (a *ssdpAdvertiser) usn(nt string) string {
+	if nt == "uuid:"+a.uuid {
+		return nt
 	}
-	defer resp.Body.Close()
+	return "uuid:" + a.uuid + "::" + nt
+}
 
-	log.Printf("Fetched URL %s, Status: %s, Content-Type: %s", req.URL, resp.Status, resp.Header.Get("Content-Type"))
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Non-OK status code for URL %s: %s", req.URL, resp.Status)
-		http.Error(w, fmt.Sprintf("Failed to fetch .torrent file from URL: %s", resp.Status), resp.StatusCode)
-		return
+// notify multicasts a NOTIFY message with the given NTS (ssdp:alive or ssdp:byebye)
+// for every notification type.
+func (a *ssdpAdvertiser) notify(nts string) {
+	for _, nt := range a.notificationTypes() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + ssdpMulticastAddr + "\r\n" +
+			fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+			"LOCATION: " + a.location + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"SERVER: " + a.server + "\r\n" +
+			"USN: " + a.usn(nt) + "\r\n\r\n"
+		if _, err := a.conn.WriteToUDP([]byte(msg), a.group); err != nil {
+			slog.Warn("Error sending SSDP notification", "nts", nts, "err", err)
+			return
+		}
 	}
+}
 
-	torrentBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading .torrent content from URL %s: %v", req.URL, err)
-		http.Error(w, fmt.Sprintf("Failed to read .torrent content: %v", err), http.StatusInternalServerError)
-		return
+// byebye tells renderers the server is going away.
+func (a *ssdpAdvertiser) byebye() {
+	a.notify("ssdp:byebye")
+}
+
+// serve answers M-SEARCH requests received on the multicast group.
+func (a *ssdpAdvertiser) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			slog.Error("SSDP listener stopped", "err", err)
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		st := req.Header.Get("ST")
+		for _, nt := range a.notificationTypes() {
+			if st != "ssdp:all" && st != nt {
+				continue
+			}
+			msg := "HTTP/1.1 200 OK\r\n" +
+				fmt.Sprintf("CACHE-CONTROL: max-age=%d\r\n", ssdpMaxAge) +
+				"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+				"EXT:\r\n" +
+				"LOCATION: " + a.location + "\r\n" +
+				"SERVER: " + a.server + "\r\n" +
+				"ST: " + nt + "\r\n" +
+				"USN: " + a.usn(nt) + "\r\n\r\n"
+			if _, err := a.conn.WriteToUDP([]byte(msg), src); err != nil {
+				slog.Warn("Error answering SSDP search", "to", src, "err", err)
+			}
+		}
 	}
+}
 
-	log.Printf("Successfully read %d bytes from URL: %s", len(torrentBytes), req.URL)
-	mi, err := metainfo.Load(bytes.NewReader(torrentBytes))
+// lanIP returns the local address used to reach the SSDP multicast group, which is
+// the address renderers on the LAN can connect back to.
+func lanIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", ssdpMulticastAddr)
 	if err != nil {
-		log.Printf("Error parsing .torrent file from URL %s: %v", req.URL, err)
-		http.Error(w, fmt.Sprintf("Failed to parse .torrent file from URL: %v", err), http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
 
-	magnetLink := mi.Magnet(nil, nil).String()
-	log.Printf("Successfully generated magnet link for URL %s: %s", req.URL, magnetLink);
+// xmlEscape escapes s for use in XML text and attribute values.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
 
-	response := map[string]string{"magnetLink": magnetLink}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// dlnaDeviceDescription serves the UPnP device description for the media server.
+func dlnaDeviceDescription(uuid, friendlyName string) http.HandlerFunc {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <device>
+    <deviceType>` + dlnaDeviceType + `</deviceType>
+    <friendlyName>` + xmlEscape(friendlyName) + `</friendlyName>
+    <manufacturer>rsd93</manufacturer>
+    <modelName>rsd93 torrent streamer</modelName>
+    <UDN>uuid:` + uuid + `</UDN>
+    <serviceList>
+      <service>
+        <serviceType>` + dlnaContentDirectoryType + `</serviceType>
+        <serviceId>urn:upnp-org:serviceId:ContentDirectory</serviceId>
+        <SCPDURL>/dlna/ContentDirectory.xml</SCPDURL>
+        <controlURL>/dlna/control/ContentDirectory</controlURL>
+        <eventSubURL>/dlna/event/ContentDirectory</eventSubURL>
+      </service>
+    </serviceList>
+  </device>
+</root>`
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		io.WriteString(w, body)
+	}
 }
 
+// contentDirectorySCPD describes the ContentDirectory actions implemented by
+// dlnaControlHandler.
+const contentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>
+<scpd xmlns="urn:schemas-upnp-org:service-1-0">
+  <specVersion><major>1</major><minor>0</minor></specVersion>
+  <actionList>
+    <action><name>Browse</name><argumentList>
+      <argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>
+      <argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>
+      <argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>
+      <argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>
+      <argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>
+      <argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>
+      <argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>
+      <argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSearchCapabilities</name><argumentList>
+      <argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSortCapabilities</name><argumentList>
+      <argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument>
+    </argumentList></action>
+    <action><name>GetSystemUpdateID</name><argumentList>
+      <argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument>
+    </argumentList></action>
+  </actionList>
+  <serviceStateTable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType>
+      <allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList>
+    </stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>
+    <stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>
+  </serviceStateTable>
+</scpd>`
+
+func dlnaSCPDHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, contentDirectorySCPD)
+}
 
-func (tc *TorrentClient) filesHandler(w http.ResponseWriter, r *http.Request) {
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
-		return
+// dlnaEventHandler accepts event subscriptions so renderers that insist on
+// subscribing don't give up. No events are sent; renderers re-browse instead.
+func dlnaEventHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid, err := newDLNAUUID()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("SID", "uuid:"+sid)
+		w.Header().Set("TIMEOUT", fmt.Sprintf("Second-%d", ssdpMaxAge))
+	case "UNSUBSCRIBE":
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
-	t, err := tc.getTorrentFromMagnet(magnetLink)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+}
+
+// dlnaItem is a streamable file exposed in the ContentDirectory.
+type dlnaItem struct {
+	id          string // Torrent infohash
+	title       string
+	contentType string
+	size        int64
+	url         string
+}
+
+// dlnaItems lists the default file of every cached torrent, pointing at /stream.
+func (tc *TorrentClient) dlnaItems(baseURL string) []dlnaItem {
+	items := []dlnaItem{}
+	for _, key := range tc.cache.Keys() {
+		val, ok := tc.cache.Peek(key)
+		if !ok {
+			continue
+		}
+		t := val.(*cacheEntry).torrent
+		if t.Info() == nil {
+			continue
+		}
+		file := tc.getFileToStream(t, -1)
+		if file == nil {
+			continue
+		}
+		index := 0
+		for i, f := range t.Files() {
+			if f == file {
+				index = i
+				break
+			}
+		}
+		infoHash := t.InfoHash().HexString()
+		streamURL := fmt.Sprintf("%s/stream?url=%s&index=%d", baseURL, url.QueryEscape("magnet:?xt=urn:btih:"+infoHash), index)
+		items = append(items, dlnaItem{id: infoHash, title: filepath.Base(file.DisplayPath()),
+			contentType: getContentType(file.DisplayPath()), size: file.Length(), url: streamURL})
 	}
-	var fileList []FileInfo
-	for _, file := range t.Files() {
-		isSubtitle := strings.HasSuffix(strings.ToLower(file.DisplayPath()), ".srt")
-		fileList = append(fileList, FileInfo{Path: file.DisplayPath(), Size: file.Length(), SizeHuman: humanReadableSize(file.Length()), IsSubtitle: isSubtitle})
+	return items
+}
+
+// didl renders the DIDL-Lite metadata for the item.
+func (item dlnaItem) didl() string {
+	class := "object.item"
+	switch {
+	case strings.HasPrefix(item.contentType, "video/"):
+		class = "object.item.videoItem"
+	case strings.HasPrefix(item.contentType, "audio/"):
+		class = "object.item.audioItem"
 	}
-	response := struct {
-		InfoHash string
-		Files    []FileInfo
-	}{InfoHash: t.InfoHash().HexString(), Files: fileList}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	return fmt.Sprintf(`<item id="%s" parentID="0" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class><res protocolInfo="http-get:*:%s:*" size="%d">%s</res></item>`,
+		item.id, xmlEscape(item.title), class, xmlEscape(item.contentType), item.size, xmlEscape(item.url))
 }
 
-func (tc *TorrentClient) metadataHandler(w http.ResponseWriter, r *http.Request) {
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
+func wrapDIDL(content string) string {
+	return `<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">` +
+		content + `</DIDL-Lite>`
+}
+
+// writeSOAPResponse writes a ContentDirectory action response with the given
+// already-escaped output arguments.
+func writeSOAPResponse(w http.ResponseWriter, action, args string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("EXT", "")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><u:%sResponse xmlns:u="%s">%s</u:%sResponse></s:Body></s:Envelope>`,
+		action, dlnaContentDirectoryType, args, action)
+}
+
+// writeSOAPFault writes a UPnP error (e.g. 401 Invalid Action, 701 No such object).
+func writeSOAPFault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`,
+		code, xmlEscape(description))
+}
+
+// dlnaControlHandler implements the ContentDirectory SOAP actions. The root
+// container "0" holds one item per cached torrent.
+func (tc *TorrentClient) dlnaControlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-	t, err := tc.getTorrentFromMagnet(magnetLink)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	soapAction := strings.Trim(r.Header.Get("SOAPACTION"), `"`)
+	action := soapAction[strings.LastIndex(soapAction, "#")+1:]
+
+	var envelope struct {
+		Body struct {
+			Browse struct {
+				ObjectID       string
+				BrowseFlag     string
+				StartingIndex  int
+				RequestedCount int
+			}
+		}
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&envelope); err != nil {
+		slog.Warn("Invalid DLNA control request", "action", action, "err", err)
+		writeSOAPFault(w, 402, "Invalid Args")
 		return
 	}
-	var totalSize int64
-	for _, file := range t.Files() {
-		totalSize += file.Length()
+	updateID := tc.torrentsAdded.Load()
+
+	switch action {
+	case "GetSearchCapabilities":
+		writeSOAPResponse(w, action, "<SearchCaps></SearchCaps>")
+	case "GetSortCapabilities":
+		writeSOAPResponse(w, action, "<SortCaps></SortCaps>")
+	case "GetSystemUpdateID":
+		writeSOAPResponse(w, action, fmt.Sprintf("<Id>%d</Id>", updateID))
+	case "Browse":
+		browse := envelope.Body.Browse
+		items := tc.dlnaItems(requestBaseURL(r))
+		slog.Debug("DLNA browse", "objectID", browse.ObjectID, "flag", browse.BrowseFlag, "items", len(items), "from", r.RemoteAddr)
+
+		var result strings.Builder
+		returned, total := 0, 0
+		switch {
+		case browse.ObjectID == "0" && browse.BrowseFlag == "BrowseMetadata":
+			fmt.Fprintf(&result, `<container id="0" parentID="-1" restricted="1" childCount="%d"><dc:title>rsd93</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`, len(items))
+			returned, total = 1, 1
+		case browse.ObjectID == "0":
+			total = len(items)
+			start := min(max(browse.StartingIndex, 0), total)
+			end := total
+			if browse.RequestedCount > 0 {
+				end = min(start+browse.RequestedCount, total)
+			}
+			for _, item := range items[start:end] {
+				result.WriteString(item.didl())
+			}
+			returned = end - start
+		default:
+			for _, item := range items {
+				if item.id == browse.ObjectID && browse.BrowseFlag == "BrowseMetadata" {
+					result.WriteString(item.didl())
+					returned, total = 1, 1
+				}
+			}
+			if total == 0 {
+				writeSOAPFault(w, 701, "No such object")
+				return
+			}
+		}
+		writeSOAPResponse(w, action, fmt.Sprintf("<Result>%s</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>%d</UpdateID>",
+			xmlEscape(wrapDIDL(result.String())), returned, total, updateID))
+	default:
+		writeSOAPFault(w, 401, "Invalid Action")
 	}
-	metadata := Metadata{Name: t.Name(), InfoHash: t.InfoHash().HexString(), TotalSize: totalSize, TotalSizeHuman: humanReadableSize(totalSize), FileCount: len(t.Files())}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(metadata)
 }
 
-func (tc *TorrentClient) statusHandler(w http.ResponseWriter, r *http.Request) {
-	magnetLink := r.URL.Query().Get("url")
-	if magnetLink == "" {
-		http.Error(w, "Missing 'url' query parameter", http.StatusBadRequest)
-		return
+// --- IP Blocklist ---
+
+// countingBlocklist counts the lookups that hit a range, i.e. the peer addresses
+// the torrent client refused, for /stats.
+type countingBlocklist struct {
+	iplist.Ranger
+	blocked atomic.Int64
+}
+
+func (b *countingBlocklist) Lookup(ip net.IP) (iplist.Range, bool) {
+	r, ok := b.Ranger.Lookup(ip)
+	if ok {
+		b.blocked.Add(1)
 	}
-	spec, err := metainfo.ParseMagnetURI(magnetLink)
+	return r, ok
+}
+
+// loadBlocklist reads an IP filter file: eMule format when the name ends in
+// .dat, else the PeerGuardian text (P2P) format.
+func loadBlocklist(path string) (*iplist.IPList, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid magnet link: %v", err), http.StatusBadRequest)
-		return
+		return nil, err
 	}
-	infoHashStr := spec.InfoHash.HexString()
-	val, found := tc.cache.Get(infoHashStr)
-	if !found {
-		http.Error(w, "Torrent not found or not active", http.StatusNotFound)
-		return
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(path), ".dat") {
+		return parseEmuleBlocklist(f)
 	}
+	return iplist.NewFromReader(f)
+}
 
-	cachedEntry := val.(*cacheEntry)
-	t := cachedEntry.torrent
-	<-t.GotInfo()
-
-	var streamingFileSize int64
-	var streamingFileSizeHuman string
-
-	indexStr := r.URL.Query().Get("index")
-	if indexStr != "" {
-		index, parseErr := strconv.Atoi(indexStr)
-		if parseErr == nil {
-			streamingFile := getFileToStream(t, index)
-			if streamingFile != nil {
-				streamingFileSize = streamingFile.Length()
-				streamingFileSizeHuman = humanReadableSize(streamingFileSize)
+// parseEmuleBlocklist parses eMule ipfilter.dat lines of the form
+// "001.002.004.000 - 001.002.004.255 , 000 , description". As in eMule, only
+// ranges with an access level below 128 block.
+func parseEmuleBlocklist(r io.Reader) (*iplist.IPList, error) {
+	var ranges []iplist.Range
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		fields := strings.SplitN(line, ",", 3)
+		first, last, ok := strings.Cut(fields[0], "-")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing hyphen", lineNum)
+		}
+		rng := iplist.Range{First: parsePaddedIPv4(first), Last: parsePaddedIPv4(last)}
+		if rng.First == nil || rng.Last == nil {
+			return nil, fmt.Errorf("line %d: bad IP range", lineNum)
+		}
+		if len(fields) > 1 {
+			level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad access level", lineNum)
 			}
+			if level >= 128 {
+				continue
+			}
+		}
+		if len(fields) > 2 {
+			rng.Description = strings.TrimSpace(fields[2])
 		}
+		ranges = append(ranges, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].First, ranges[j].First) < 0 })
+	return iplist.New(ranges), nil
+}
 
-	var fileStatuses []FileStatus
-	for _, file := range t.Files() {
-		fileSize := file.Length()
-		bytesCompleted := file.BytesCompleted()
-		percentage := 0.0
-		if fileSize > 0 {
-			percentage = float64(bytesCompleted) / float64(fileSize) * 100
+// parsePaddedIPv4 parses an IPv4 address whose octets may be zero-padded
+// ("001.002.004.000"), which net.ParseIP rejects. It returns the 4-byte form, or nil.
+func parsePaddedIPv4(s string) net.IP {
+	octets := strings.Split(strings.TrimSpace(s), ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, octet := range octets {
+		n, err := strconv.ParseUint(octet, 10, 8)
+		if err != nil {
+			return nil
 		}
-		fileStatuses = append(fileStatuses, FileStatus{Path: file.DisplayPath(), Size: fileSize, BytesCompleted: bytesCompleted, PercentageCompleted: percentage})
+		ip[i] = byte(n)
 	}
-	totalBytes := t.Info().TotalLength()
-	bytesCompleted := t.BytesCompleted()
+	return ip
+}
 
-	var downloadSpeed float64
-	now := time.Now()
+// --- Prometheus Metrics ---
 
-	cachedEntry.mu.Lock()
-	timeDelta := now.Sub(cachedEntry.prevReadTime).Seconds()
-	if timeDelta > 0.5 { // Only update speed every half second to avoid noisy data
-		byteDelta := bytesCompleted - cachedEntry.prevBytesRead
-		downloadSpeed = float64(byteDelta) / timeDelta
+var (
+	metricActiveTorrents = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rsd_active_torrents", Help: "Number of torrents in the in-memory cache.",
+	})
+	metricBytesDownloaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rsd_downloaded_bytes_total", Help: "Useful bytes downloaded from peers.",
+	})
+	metricDownloadSpeed = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rsd_download_speed_bytes_per_second", Help: "Aggregate download speed over the last sweep interval.",
+	})
+	metricConnectedPeers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rsd_connected_peers", Help: "Active peer connections across all cached torrents.",
+	})
+	metricCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rsd_cache_evictions_total", Help: "Torrents removed from the in-memory cache.",
+	})
+	metricSubtitleExtractions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rsd_subtitle_extractions_total", Help: "Finished ffmpeg subtitle extractions by result.",
+	}, []string{"result"})
+	metricPersistFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rsd_metadata_persist_failures_total", Help: "Torrent metainfo writes to LotusDB that failed after all retries.",
+	})
+)
 
-		cachedEntry.prevBytesRead = bytesCompleted
-		cachedEntry.prevReadTime = now
-	}
-	cachedEntry.mu.Unlock()
+func registerMetrics() {
+	prometheus.MustRegister(metricActiveTorrents, metricBytesDownloaded, metricDownloadSpeed,
+		metricConnectedPeers, metricCacheEvictions, metricSubtitleExtractions, metricPersistFailures)
+}
 
-	percentageCompleted := 0.0
-	if totalBytes > 0 {
-		percentageCompleted = float64(bytesCompleted) / float64(totalBytes) * 100
-	}
+// periodicMetrics refreshes the torrent gauges and the downloaded-bytes counter
+// every interval until the client's context is cancelled.
+func (tc *TorrentClient) periodicMetrics(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	response := StatusInfo{
-		InfoHash:            t.InfoHash().HexString(), Name: t.Name(), TotalBytes: totalBytes, BytesCompleted: bytesCompleted,
-		PercentageCompleted: percentageCompleted, DownloadSpeedBps:    downloadSpeed,
-		DownloadSpeedHuman:  humanReadableSpeed(downloadSpeed),
-		ConnectedPeers:      t.Stats().ActivePeers, Files:               fileStatuses,
-		StreamingFileSize:   streamingFileSize,
-		StreamingFileSizeHuman: streamingFileSizeHuman,
+	stats := tc.client.Stats()
+	prevBytes := stats.BytesReadUsefulData.Int64()
+	prevTime := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			stats := tc.client.Stats()
+			bytesRead := stats.BytesReadUsefulData.Int64()
+			if delta := bytesRead - prevBytes; delta > 0 {
+				metricBytesDownloaded.Add(float64(delta))
+				metricDownloadSpeed.Set(float64(delta) / now.Sub(prevTime).Seconds())
+			} else {
+				metricDownloadSpeed.Set(0)
+			}
+			prevBytes, prevTime = bytesRead, now
+
+			metricActiveTorrents.Set(float64(tc.cache.Len()))
+			metricConnectedPeers.Set(float64(tc.activePeerCount()))
+		case <-tc.ctx.Done():
+			return
+		}
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
 }
 
-func (tc *TorrentClient) Close() {
-	tc.client.Close()
-	if err := tc.db.Close(); err != nil {
-		log.Printf("Error closing LotusDB: %v", err)
+// --- Completion Webhook ---
+
+// CompletionEvent is the JSON body POSTed to -completion-webhook.
+type CompletionEvent struct {
+	InfoHash   string `json:"infoHash"`
+	Name       string `json:"name"`
+	Path       string `json:"path"` // Where the torrent's data is stored on disk
+	TotalBytes int64  `json:"totalBytes"`
+}
+
+// watchCompletions checks the active torrents every interval and calls the
+// completion webhook once for each torrent that has finished downloading.
+func (tc *TorrentClient) watchCompletions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	webhookClient := &http.Client{Timeout: 10 * time.Second}
+	for {
+		select {
+		case <-ticker.C:
+			for _, key := range tc.cache.Keys() {
+				val, ok := tc.cache.Peek(key)
+				if !ok {
+					continue
+				}
+				entry := val.(*cacheEntry)
+				t := entry.torrent
+				if t.Info() == nil || t.BytesCompleted() != t.Length() {
+					continue
+				}
+				entry.mu.Lock()
+				notified := entry.completionNotified
+				entry.completionNotified = true
+				entry.mu.Unlock()
+				if notified {
+					continue
+				}
+				event := CompletionEvent{InfoHash: t.InfoHash().HexString(), Name: t.Name(),
+					Path: filepath.Join(entry.dataDir, t.Name()), TotalBytes: t.Length()}
+				go tc.notifyCompletion(webhookClient, event)
+			}
+		case <-tc.ctx.Done():
+			return
+		}
 	}
 }
 
-func (tc *TorrentClient) restartHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Restart triggered via API.")
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "The server has been restarted.")
-	// Non-blocking send in case no one is listening.
-	select {
-	case tc.restartChan <- true:
-	default:
+func (tc *TorrentClient) notifyCompletion(client *http.Client, event CompletionEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding completion event", "infoHash", event.InfoHash, "err", err)
+		return
+	}
+	resp, err := client.Post(tc.completionWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Completion webhook failed", "infoHash", event.InfoHash, "name", event.Name, "err", err)
+		return
 	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("Completion webhook returned an error status", "infoHash", event.InfoHash, "name", event.Name, "status", resp.Status)
+		return
+	}
+	slog.Info("Completion webhook notified", "infoHash", event.InfoHash, "name", event.Name)
 }
 
 // --- Automatic Cleanup of Inactive Torrents ---
 
 func (tc *TorrentClient) cleanupInactiveTorrents(maxInactiveTime time.Duration) {
-	log.Println("Running cleanup for inactive torrents...")
+	slog.Debug("Running cleanup for inactive torrents")
 	keysToDrop := []string{}
 
 	for _, key := range tc.cache.Keys() {
@@ -969,30 +6350,89 @@ func (tc *TorrentClient) cleanupInactiveTorrents(maxInactiveTime time.Duration)
 				if !isString {
 					continue
 				}
-				log.Printf("Torrent '%s' (hash: %s) inactive for %v, queueing for removal.", entry.torrent.Name(), infoHashStr, inactiveDuration)
+				slog.Info("Torrent inactive, queueing for removal", "infoHash", infoHashStr, "name", entry.torrent.Name(), "inactive", inactiveDuration)
 				keysToDrop = append(keysToDrop, infoHashStr)
 			}
 		}
 	}
 
 	if len(keysToDrop) > 0 {
-		log.Printf("Removing %d inactive torrent(s).", len(keysToDrop))
+		slog.Info("Removing inactive torrents", "count", len(keysToDrop))
 		for _, infoHash := range keysToDrop {
 			if val, ok := tc.cache.Get(infoHash); ok {
 				entry := val.(*cacheEntry)
-				log.Printf("Dropping torrent '%s' (hash: %s).", entry.torrent.Name(), infoHash)
+				slog.Info("Dropping torrent", "infoHash", infoHash, "name", entry.torrent.Name(), "reason", "inactive")
 				entry.torrent.Drop()
 				tc.cache.Remove(infoHash)
-				if err := tc.db.Delete([]byte(infoHash)); err != nil {
-					log.Printf("Failed to delete torrent metadata from LotusDB for hash %s: %v", infoHash, err)
-				}
+				tc.deleteMetainfo(infoHash)
 			}
 		}
+		tc.saveSession()
 	} else {
-		log.Println("No inactive torrents to clean up.")
+		slog.Debug("No inactive torrents to clean up")
+	}
+}
+
+// enforceDiskUsage deletes the data of the least recently used cached torrents
+// until the data of all cached torrents fits in -max-disk-usage. Torrents that
+// are being streamed are kept.
+func (tc *TorrentClient) enforceDiskUsage() {
+	type usage struct {
+		infoHash     string
+		entry        *cacheEntry
+		info         *metainfo.Info
+		paths        []string
+		size         int64
+		lastAccessed time.Time
+	}
+	var usages []usage
+	var total int64
+	for _, key := range tc.cache.Keys() {
+		val, ok := tc.cache.Peek(key)
+		infoHash, isString := key.(string)
+		if !ok || !isString {
+			continue
+		}
+		entry := val.(*cacheEntry)
+		info := entry.torrent.Info()
+		if info == nil {
+			continue
+		}
+		_, paths, size := tc.dataOnDisk(info, entry.dataDir)
+		entry.mu.Lock()
+		lastAccessed := entry.lastAccessed
+		entry.mu.Unlock()
+		usages = append(usages, usage{infoHash, entry, info, paths, size, lastAccessed})
+		total += size
+	}
+	if total <= tc.maxDiskUsage {
+		slog.Debug("Disk usage within limit", "used", humanReadableSize(total), "limit", humanReadableSize(tc.maxDiskUsage))
+		return
+	}
+
+	sort.Slice(usages, func(i, j int) bool { return usages[i].lastAccessed.Before(usages[j].lastAccessed) })
+	for _, u := range usages {
+		if total <= tc.maxDiskUsage {
+			break
+		}
+		u.entry.mu.Lock()
+		streaming := u.entry.activeStreams > 0
+		u.entry.mu.Unlock()
+		if streaming || u.size == 0 {
+			continue
+		}
+		slog.Info("Dropping torrent", "infoHash", u.infoHash, "name", u.info.BestName(), "reason", "disk usage", "size", humanReadableSize(u.size))
+		tc.purgeTorrent(u.infoHash, u.info, u.entry.dataDir, u.paths)
+		total -= u.size
+	}
+	if total > tc.maxDiskUsage {
+		slog.Warn("Disk usage still above limit, remaining torrents are being streamed", "used", humanReadableSize(total), "limit", humanReadableSize(tc.maxDiskUsage))
 	}
 }
 
+// periodicCleanup runs the inactivity cleanup (when maxInactiveTime > 0), the
+// disk usage limit (when -max-disk-usage is set) and metadata expiry (when
+// -metadata-ttl is set) every interval.
 func (tc *TorrentClient) periodicCleanup(interval time.Duration, maxInactiveTime time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -1000,14 +6440,115 @@ func (tc *TorrentClient) periodicCleanup(interval time.Duration, maxInactiveTime
 	for {
 		select {
 		case <-ticker.C:
-			tc.cleanupInactiveTorrents(maxInactiveTime)
+			if maxInactiveTime > 0 {
+				tc.cleanupInactiveTorrents(maxInactiveTime)
+			}
+			if tc.maxDiskUsage > 0 {
+				tc.enforceDiskUsage()
+			}
+			if tc.metadataTTL > 0 {
+				tc.expireMetadata()
+			}
 		case <-tc.ctx.Done():
-			log.Println("Stopping periodic cleanup.")
+			slog.Info("Stopping periodic cleanup")
 			return
 		}
 	}
 }
 
+// serverProtocols returns the HTTP protocols the server accepts. HTTP/1.1 and
+// HTTP/2 over TLS are always enabled; HTTP/2 cleartext (h2c) is opt-in so that
+// status polls can be multiplexed alongside the stream behind a reverse proxy.
+func serverProtocols(enableH2C bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	if enableH2C {
+		slog.Info("HTTP/2 cleartext (h2c) is enabled")
+		protocols.SetUnencryptedHTTP2(true)
+	}
+	return protocols
+}
+
+// serverHTTP2Config tunes HTTP/2 for -http2-max-concurrent-streams and
+// -http2-window. Zero values keep Go's defaults.
+func serverHTTP2Config(maxConcurrentStreams, window int) *http.HTTP2Config {
+	slog.Info("HTTP/2 settings", "maxConcurrentStreams", maxConcurrentStreams, "window", window)
+	return &http.HTTP2Config{
+		MaxConcurrentStreams:          maxConcurrentStreams,
+		MaxReceiveBufferPerStream:     window,
+		MaxReceiveBufferPerConnection: window,
+	}
+}
+
+// setupLogging installs the default slog logger for -log-format and -log-level.
+// Output from the standard log package, including log.Fatal, goes through it too.
+func setupLogging(format, level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format %q: must be 'text' or 'json'", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// startHTTPSRedirectServer listens for plain HTTP on listenHost:redirectPort and
+// permanently redirects every request to the same host and path on httpsPort.
+func startHTTPSRedirectServer(listenHost string, redirectPort, httpsPort int) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+	addr := net.JoinHostPort(listenHost, strconv.Itoa(redirectPort))
+	go func() {
+		slog.Info("Redirecting plain HTTP to HTTPS", "addr", addr, "httpsPort", httpsPort)
+		if err := http.ListenAndServe(addr, handler); err != nil {
+			slog.Error("HTTP redirect server error", "err", err)
+		}
+	}()
+}
+
+// startPprofServer serves net/http/pprof on addr. It is meant to be bound to
+// loopback only, as profiles expose internal state.
+func startPprofServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("Invalid -pprof-addr %q: %v", addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		slog.Warn("pprof is bound to a non-loopback address; profiles will be reachable from the network", "addr", addr)
+	}
+	go func() {
+		slog.Info("pprof listening", "url", "http://"+addr+"/debug/pprof/")
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("pprof server error", "err", err)
+		}
+	}()
+}
+
 // --- Main Function ---
 func main() {
 	// Current state: All core functionalities (magnet links, remote .torrent URLs, streaming, VTT conversion/streaming) are confirmed working as of the last successful test. Build: 7342
@@ -1016,83 +6557,376 @@ func main() {
 	var defaultDownloadDir string
 	usr, errUser := user.Current()
 	if errUser != nil {
-		log.Printf("Warning: Could not get current user home directory: %v. Falling back to current directory for downloads.", errUser)
+		slog.Warn("Could not get current user home directory, falling back to current directory for downloads", "err", errUser)
 		defaultDownloadDir = "."
 	} else {
 		defaultDownloadDir = filepath.Join(usr.HomeDir, "Downloads")
 	}
 
 	port := flag.Int("port", 3000, "Port to listen on")
+	listenAddr := flag.String("listen-addr", "", "Interface address to bind, e.g. '127.0.0.1' for loopback only (empty = all interfaces)")
 	downloadDir := flag.String("download-dir", defaultDownloadDir, "Directory to save downloaded files")
 	cleanupInactiveAfter := flag.Duration("cleanup-inactive-after", 30*time.Minute, "Duration after which to clean up inactive torrents (e.g., '30m', '2h'). Set to '0' to disable.")
+	cleanupInterval := flag.Duration("cleanup-interval", 0, "How often to check for inactive torrents, disk usage and expired metadata. Defaults to 5m or half of -cleanup-inactive-after, whichever is shorter.")
+	maxDiskUsage := flag.Int64("max-disk-usage", 0, "Maximum bytes on disk for the data of cached torrents; the cleanup sweep deletes the least recently used torrents' data above it (0 = unlimited)")
+	indexerURL := flag.String("indexer-url", "", "Base URL of a Torznab-compatible indexer (e.g. Jackett) for /search. Leave empty to disable search.")
+	indexerAPIKey := flag.String("indexer-api-key", "", "API key for the indexer configured with -indexer-url")
+	enableTranscode := flag.Bool("enable-transcode", false, "Serve /transcode, which re-encodes files the browser can't play (e.g. HEVC, AC3) to H.264/AAC with ffmpeg. CPU intensive.")
+	verifyOnLoad := flag.Bool("verify-on-load", false, "Re-hash the data of every added torrent that already has files on disk, even pieces marked complete, to catch disk corruption. Progress is reported by /status.")
+	verifyOnReadd := flag.Bool("verify-on-readd", true, "Verify a re-added torrent in the background when its data is already fully on disk, so status reports completion immediately")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma-separated list of origins allowed to call the API cross-origin (e.g. 'https://app.example.com'), or '*' for any. Empty reflects every origin (development mode).")
+	uploadMode := flag.String("upload-mode", UploadModeNormal, "Upload behaviour: 'normal', 'reciprocal' (only upload to peers that upload to us) or 'none' (never upload). Limiting upload saves bandwidth on metered connections but may reduce download speed.")
+	allowPrivateFetch := flag.Bool("allow-private-fetch", false, "Allow /fetch-torrent-url to download from private, loopback and link-local addresses")
+	bufferSeconds := flag.Float64("buffer-seconds", 30, "Seconds of playback to buffer ahead of the stream position, converted to bytes via the file's probed bitrate (requires ffprobe). Set to 0 to disable.")
+	enableMetrics := flag.Bool("metrics", false, "Expose Prometheus metrics at /metrics")
+	enablePprof := flag.Bool("pprof", false, "Expose net/http/pprof profiling handlers on -pprof-addr")
+	pprofAddr := flag.String("pprof-addr", "localhost:6060", "Address for the pprof server (keep this on loopback)")
+	memoryLimit := flag.Int64("memory-limit", 0, "Soft memory limit in bytes for the Go runtime (0 = no limit)")
+	perSessionDirs := flag.Bool("per-session-dirs", false, "Store data and subtitles of requests with an X-Session-ID header (or sessionId query parameter) under <download-dir>/<session-id>/")
+	completionWebhook := flag.String("completion-webhook", "", "URL to POST a JSON notification (infoHash, name, path, totalBytes) to when an active torrent finishes downloading")
+	minFreeSpace := flag.String("min-free-space", "0", "Refuse to add torrents (507 Insufficient Storage) when the download directory has less free space than this: bytes, or a percentage like '5%' (0 = no check)")
+	maxStreamsPerTorrent := flag.Int("max-streams-per-torrent", 8, "Maximum concurrent /stream connections per torrent; further requests get 429 Too Many Requests (0 = unlimited)")
+	connsPerTorrent := flag.Int("conns-per-torrent", 100, "Maximum established peer connections per torrent. Lower it on constrained networks, raise it on fast servers.")
+	halfOpenConns := flag.Int("half-open-conns", 25, "Maximum peer connection attempts in progress per torrent")
+	totalHalfOpenConns := flag.Int("total-half-open-conns", 100, "Maximum peer connection attempts in progress across all torrents")
+	disableUTP := flag.Bool("disable-utp", false, "Don't use uTP for peer connections (some NATs and corporate networks mishandle it)")
+	disableTCP := flag.Bool("disable-tcp", false, "Don't use TCP for peer connections")
+	disableIPv6 := flag.Bool("disable-ipv6", false, "Don't listen on or connect to peers over IPv6")
+	blocklistPath := flag.String("blocklist", "", "Path to an IP blocklist in P2P text format or eMule .dat format; peers in its ranges are never contacted. Reloaded on /restart.")
+	streamReadTimeout := flag.Duration("stream-read-timeout", 60*time.Second, "End a /stream or /download response when no torrent data arrives for this long, so the player can retry instead of hanging (0 = wait forever)")
+	dbEncryptionKey := flag.String("db-encryption-key", "", "Hex-encoded AES key (32, 48 or 64 hex characters) to encrypt torrent metadata stored in LotusDB. Leave empty to store it in plaintext.")
+	maxConcurrentMetadata := flag.Int("max-concurrent-metadata", 10, "Maximum torrents fetching their info from the swarm at once; further new magnets wait for a slot (0 = unlimited)")
+	maxConcurrentExtractions := flag.Int("max-concurrent-extractions", 2, "Maximum ffmpeg subtitle extractions running at once; further requests wait in a queue (0 = unlimited)")
+	defaultFileStrategy := flag.String("default-file-strategy", FileStrategyLargest, "File streamed when a request gives no 'index' or 'path': 'largest', 'first-video' (first file with a video extension, in torrent order) or 'alphabetical-first'")
+	noPersist := flag.Bool("no-persist", false, "Don't store torrent metadata, sessions or subtitle mappings in LotusDB (no lotusdb_meta directory is created)")
+	sequential := flag.Bool("sequential", false, "Download streamed files in roughly playback order by default (override per request with sequential=true|false). Smoother playback, but worse for swarm health.")
+	streamBufferSize := flag.Int("stream-buffer-size", 512<<10, "Size in bytes of the pooled buffers that /stream and /download copy torrent data through. Set to 0 to use net/http's 32KB copy buffers.")
+	readaheadBytes := flag.Int64("readahead-bytes", 16<<20, "Bytes to read and prioritize ahead of the stream position (and after a seek) when -buffer-seconds can't be applied. Set to 0 for the library default.")
+	metadataTTL := flag.Duration("metadata-ttl", 0, "Delete persisted torrent metadata that hasn't been used for this long, e.g. 720h (0 = keep forever)")
+	metadataTimeout := flag.Duration("metadata-timeout", 30*time.Second, "How long to wait for a magnet link's torrent info before giving up (per attempt)")
+	metadataRetries := flag.Int("metadata-retries", 2, "Extra waits for torrent info when a timeout looks like a transient network failure (0 disables retrying)")
+	maxDownloadRate := flag.Int64("max-download-rate", 0, "Maximum download rate from peers in bytes per second (0 = unlimited)")
+	maxUploadRate := flag.Int64("max-upload-rate", 0, "Maximum upload rate to peers in bytes per second (0 = unlimited)")
+	extraTrackersFlag := flag.String("extra-trackers", "", "Announce URLs to append to every torrent: a comma-separated list or a path to a file with one URL per line")
+	restoreSession := flag.Bool("restore-session", false, "Re-add the torrents that were active before the last shutdown or restart")
+	authToken := flag.String("auth-token", "", "Require this bearer token on all requests (Authorization header or access_token query param). Leave empty to disable authentication.")
+	tlsCert := flag.String("tls-cert", "", "Path to a PEM certificate; serve HTTPS when set together with -tls-key")
+	tlsKey := flag.String("tls-key", "", "Path to the PEM private key for -tls-cert")
+	redirectHTTP := flag.Int("redirect-http", 0, "With TLS enabled, also listen for plain HTTP on this port and redirect it to HTTPS (0 = disabled)")
+	enableH2C := flag.Bool("h2c", false, "Accept HTTP/2 over cleartext (prior knowledge), e.g. behind a reverse proxy. HTTP/2 is always enabled under TLS.")
+	http2MaxStreams := flag.Int("http2-max-concurrent-streams", 250, "Maximum number of concurrent requests (streams) per HTTP/2 connection")
+	http2Window := flag.Int("http2-window", 0, "HTTP/2 flow-control window in bytes that the server advertises for request bodies, per stream and per connection (64KiB to 4MiB, 0 = Go's default)")
+	enableDLNA := flag.Bool("dlna", false, "Advertise cached torrents to smart TVs and other renderers as a DLNA/UPnP media server on the LAN")
+	dlnaName := flag.String("dlna-name", "", "Friendly name shown by DLNA renderers (default 'rsd93 (<hostname>)')")
+	logFormat := flag.String("log-format", "text", "Log output format: 'text' or 'json'")
+	logLevel := flag.String("log-level", "info", "Minimum log level: 'debug', 'info', 'warn' or 'error'")
+	pidFile := flag.String("pid-file", filepath.Join(os.TempDir(), "rss.pid"), "Path of the PID file; a running process listed in it is terminated at startup. Empty disables the PID file.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "How long /restart and /shutdown wait for active streams to finish before closing them")
+	noKillExisting := flag.Bool("no-kill-existing", false, "Don't terminate the process listed in -pid-file at startup, e.g. to run several servers on different ports")
 	flag.Parse()
 
+	if err := setupLogging(*logFormat, *logLevel); err != nil {
+		log.Fatalf("Invalid logging flags: %v", err)
+	}
+
 	// --- PID File Management ---
-	pidFile := filepath.Join(os.TempDir(), "rss.pid")
-	if pidStr, readErr := os.ReadFile(pidFile); readErr == nil { // Use readErr for local scope
-		if pid, parseErr := strconv.Atoi(string(pidStr)); parseErr == nil { // Use parseErr for local scope
-			if process, findErr := os.FindProcess(pid); findErr == nil { // Use findErr for local scope
-				if signalErr := process.Signal(syscall.Signal(0)); signalErr == nil { // Use signalErr for local scope
-					log.Printf("Found existing process with PID %d. Terminating it.", pid)
-					if killErr := process.Kill(); killErr != nil { // Use killErr for local scope
-						log.Printf("Failed to kill existing process: %v", killErr)
+	removePIDFile := func() {}
+	if *pidFile != "" {
+		if pidStr, readErr := os.ReadFile(*pidFile); readErr == nil { // Use readErr for local scope
+			if pid, parseErr := strconv.Atoi(string(pidStr)); parseErr == nil { // Use parseErr for local scope
+				if process, findErr := os.FindProcess(pid); findErr == nil { // Use findErr for local scope
+					if signalErr := process.Signal(syscall.Signal(0)); signalErr == nil { // Use signalErr for local scope
+						if *noKillExisting {
+							slog.Warn("Process in PID file is still running, leaving it alone", "pid", pid, "pidFile", *pidFile)
+						} else {
+							slog.Info("Found existing process, terminating it", "pid", pid)
+							if killErr := process.Kill(); killErr != nil { // Use killErr for local scope
+								slog.Error("Failed to kill existing process", "pid", pid, "err", killErr)
+							}
+							time.Sleep(1 * time.Second)
+						}
 					}
-					time.Sleep(1 * time.Second)
 				}
 			}
 		}
+		if err = os.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil { // Assign to declared err
+			log.Fatalf("Failed to write PID file: %v", err)
+		}
+		removePIDFile = func() { os.Remove(*pidFile) }
+		defer removePIDFile()
 	}
-	if err = os.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil { // Assign to declared err
-		log.Fatalf("Failed to write PID file: %v", err)
-	}
-	defer os.Remove(pidFile)
 
 	// Check for ffmpeg at startup
-	log.Println("Checking for ffmpeg executable...")
-	_, err = exec.LookPath("ffmpeg")
-	if err != nil {
-		log.Fatalf("ffmpeg executable not found in system PATH. Subtitle extraction will not work.\nPlease install ffmpeg from: https://github.com/BtbN/FFmpeg-Builds/releases/tag/latest")
+	slog.Debug("Checking for ffmpeg executable")
+	ffmpegAvailable := true
+	if _, err = exec.LookPath("ffmpeg"); err != nil {
+		ffmpegAvailable = false
+		slog.Warn("ffmpeg executable not found in system PATH. Subtitle extraction will not work; streaming and sidecar subtitles are unaffected.", "download", "https://github.com/BtbN/FFmpeg-Builds/releases/tag/latest")
+	} else {
+		slog.Info("ffmpeg executable found")
 	}
-	log.Println("ffmpeg executable found.")
 	// --- End PID File Management ---
 
 	// Ensure the selected download directory exists.
-	log.Printf("Using download directory: %s", *downloadDir)
+	slog.Info("Using download directory", "path", *downloadDir)
 	if err := os.MkdirAll(*downloadDir, 0755); err != nil {
 		log.Fatalf("Failed to create download directory: %v", err)
 	}
 
+	if *memoryLimit > 0 {
+		debug.SetMemoryLimit(*memoryLimit)
+		slog.Info("Go runtime soft memory limit set", "limit", humanReadableSize(*memoryLimit))
+	}
+	if *enablePprof {
+		startPprofServer(*pprofAddr)
+	}
+	if *enableMetrics {
+		registerMetrics()
+	}
+
+	if *metadataTTL < 0 {
+		log.Fatalf("Invalid -metadata-ttl: must not be negative, got %v", *metadataTTL)
+	}
+	if *cleanupInterval < 0 {
+		log.Fatalf("Invalid -cleanup-interval: must be positive, got %v", *cleanupInterval)
+	}
+	if *cleanupInterval == 0 {
+		// A torrent is dropped at most one interval after it became inactive.
+		*cleanupInterval = 5 * time.Minute
+		if *cleanupInactiveAfter > 0 {
+			*cleanupInterval = min(*cleanupInterval, max(*cleanupInactiveAfter/2, time.Second))
+		}
+	}
+	if *maxDiskUsage < 0 {
+		log.Fatalf("Invalid -max-disk-usage: must not be negative, got %d", *maxDiskUsage)
+	}
+
+	if *connsPerTorrent < 1 || *connsPerTorrent > 10000 {
+		log.Fatalf("Invalid -conns-per-torrent: must be between 1 and 10000, got %d", *connsPerTorrent)
+	}
+	if *halfOpenConns < 1 || *totalHalfOpenConns < 1 {
+		log.Fatalf("Invalid -half-open-conns/-total-half-open-conns: must be at least 1, got %d/%d", *halfOpenConns, *totalHalfOpenConns)
+	}
+	if *halfOpenConns > *totalHalfOpenConns {
+		log.Fatalf("Invalid -half-open-conns: %d exceeds -total-half-open-conns %d", *halfOpenConns, *totalHalfOpenConns)
+	}
+
+	if *disableUTP && *disableTCP {
+		log.Fatalf("Invalid flags: -disable-utp and -disable-tcp together leave no peer transport")
+	}
+
+	var dbKey []byte
+	if *dbEncryptionKey != "" {
+		dbKey, err = hex.DecodeString(*dbEncryptionKey)
+		if err != nil || (len(dbKey) != 16 && len(dbKey) != 24 && len(dbKey) != 32) {
+			log.Fatalf("Invalid -db-encryption-key: expected 32, 48 or 64 hex characters")
+		}
+	}
+	if *streamBufferSize < 0 {
+		log.Fatalf("Invalid -stream-buffer-size: must be 0 or more, got %d", *streamBufferSize)
+	}
+	if *http2MaxStreams < 1 {
+		log.Fatalf("Invalid -http2-max-concurrent-streams: must be at least 1, got %d", *http2MaxStreams)
+	}
+	if *http2Window != 0 && (*http2Window < 64<<10 || *http2Window > 4<<20) {
+		log.Fatalf("Invalid -http2-window: must be 0 or between 64KiB and 4MiB, got %d", *http2Window)
+	}
+
+	if *completionWebhook != "" {
+		if u, err := url.Parse(*completionWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("Invalid -completion-webhook: expected an http(s) URL, got %q", *completionWebhook)
+		}
+	}
+
+	minFreeBytes, minFreePercent, err := parseFreeSpace(*minFreeSpace)
+	if err != nil {
+		log.Fatalf("Invalid -min-free-space: %v", err)
+	}
+
+	extraTrackers, err := parseTrackerList(*extraTrackersFlag)
+	if err != nil {
+		log.Fatalf("Invalid -extra-trackers: %v", err)
+	}
+	if len(extraTrackers) > 0 {
+		slog.Info("Appending extra trackers to every torrent", "count", len(extraTrackers))
+	}
+
+	useTLS := *tlsCert != "" || *tlsKey != ""
+	if useTLS {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-cert and -tls-key must be set together")
+		}
+		// Fail fast on a bad pair; the files are re-read on every (re)start, so a
+		// renewed certificate is picked up by /restart.
+		if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		if *redirectHTTP > 0 {
+			startHTTPSRedirectServer(*listenAddr, *redirectHTTP, *port)
+		}
+	} else if *redirectHTTP > 0 {
+		log.Fatal("-redirect-http requires -tls-cert and -tls-key")
+	}
+
+	var dlnaUUID, dlnaFriendlyName string
+	var ssdp *ssdpAdvertiser
+	if *enableDLNA {
+		if *authToken != "" {
+			log.Fatal("-dlna can't be combined with -auth-token: DLNA renderers can't send credentials")
+		}
+		if dlnaUUID, err = newDLNAUUID(); err != nil {
+			log.Fatalf("Failed to generate DLNA device UUID: %v", err)
+		}
+		dlnaFriendlyName = *dlnaName
+		if dlnaFriendlyName == "" {
+			hostname, _ := os.Hostname()
+			dlnaFriendlyName = fmt.Sprintf("rsd93 (%s)", hostname)
+		}
+		host := *listenAddr
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			lan, err := lanIP()
+			if err != nil {
+				log.Fatalf("Failed to determine LAN address for DLNA: %v", err)
+			}
+			host = lan.String()
+		}
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		location := fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, strconv.Itoa(*port)), dlnaDescriptionPath)
+		if ssdp, err = startSSDP(dlnaUUID, location); err != nil {
+			slog.Error("DLNA discovery is unavailable", "err", err)
+		}
+	}
+
+	origins := parseAllowedOrigins(*allowedOrigins)
+	if len(origins) == 0 {
+		slog.Warn("-allowed-origins is not set; CORS reflects any origin (development mode)")
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	for {
-		log.Println("Starting server...")
+		slog.Info("Starting server")
 		ctx, cancel := context.WithCancel(context.Background())
 		restartChan := make(chan bool, 1)
 
-		client, err := NewTorrentClient(ctx, *downloadDir, restartChan, *port)
+		client, err := NewTorrentClient(ctx, Options{
+			DownloadDir:                 *downloadDir,
+			Port:                        *port,
+			SubtitleExtractionAvailable: ffmpegAvailable,
+			IndexerURL:                  *indexerURL,
+			IndexerAPIKey:               *indexerAPIKey,
+			EnableTranscode:             *enableTranscode,
+			VerifyOnReadd:               *verifyOnReadd,
+			VerifyOnLoad:                *verifyOnLoad,
+			UploadMode:                  *uploadMode,
+			AllowPrivateFetch:           *allowPrivateFetch,
+			BufferSeconds:               *bufferSeconds,
+			RestoreSession:              *restoreSession,
+			ReadaheadBytes:              *readaheadBytes,
+			StreamBufferSize:            *streamBufferSize,
+			MetadataRetries:             *metadataRetries,
+			MaxDownloadRate:             *maxDownloadRate,
+			MaxUploadRate:               *maxUploadRate,
+			ExtraTrackers:               extraTrackers,
+			MetadataTimeout:             *metadataTimeout,
+			MetadataTTL:                 *metadataTTL,
+			Sequential:                  *sequential,
+			PerSessionDirs:              *perSessionDirs,
+			MaxStreamsPerTorrent:        *maxStreamsPerTorrent,
+			MinFreeBytes:                minFreeBytes,
+			CompletionWebhook:           *completionWebhook,
+			MinFreePercent:              minFreePercent,
+			ConnsPerTorrent:             *connsPerTorrent,
+			HalfOpenConnsPerTorrent:     *halfOpenConns,
+			TotalHalfOpenConns:          *totalHalfOpenConns,
+			DisableUTP:                  *disableUTP,
+			DisableTCP:                  *disableTCP,
+			DisableIPv6:                 *disableIPv6,
+			Blocklist:                   *blocklistPath,
+			StreamReadTimeout:           *streamReadTimeout,
+			MaxDiskUsage:                *maxDiskUsage,
+			MaxConcurrentExtractions:    *maxConcurrentExtractions,
+			MaxConcurrentMetadata:       *maxConcurrentMetadata,
+			NoPersist:                   *noPersist,
+			DefaultFileStrategy:         *defaultFileStrategy,
+			DBEncryptionKey:             dbKey,
+		}, restartChan)
 		if err != nil {
 			log.Fatalf("Failed to create torrent client: %v", err)
 		}
 
+		if err := client.startInternalServer(); err != nil {
+			log.Fatalf("Failed to start internal stream server: %v", err)
+		}
+
+		if *enableMetrics {
+			go client.periodicMetrics(5 * time.Second)
+		}
+
+		if *completionWebhook != "" {
+			go client.watchCompletions(10 * time.Second)
+		}
+
 		if *cleanupInactiveAfter > 0 {
-			log.Printf("Automatic cleanup of torrents inactive for over %v is enabled.", *cleanupInactiveAfter)
-			// Check for inactive torrents every 5 minutes.
-			go client.periodicCleanup(5*time.Minute, *cleanupInactiveAfter)
+			slog.Info("Automatic cleanup of inactive torrents is enabled", "after", *cleanupInactiveAfter, "interval", *cleanupInterval)
+		}
+		if *maxDiskUsage > 0 {
+			slog.Info("Disk usage limit is enabled", "limit", humanReadableSize(*maxDiskUsage), "interval", *cleanupInterval)
+		}
+		if *metadataTTL > 0 && !*noPersist {
+			slog.Info("Persisted metadata expiry is enabled", "ttl", *metadataTTL, "interval", *cleanupInterval)
+		}
+		if *cleanupInactiveAfter > 0 || *maxDiskUsage > 0 || (*metadataTTL > 0 && !*noPersist) {
+			go client.periodicCleanup(*cleanupInterval, *cleanupInactiveAfter)
 		}
 
+		cors := corsMiddleware(origins)
 		mux := http.NewServeMux()
-		mux.Handle("/stream", corsMiddleware(http.HandlerFunc(client.streamHandler)))
-		mux.Handle("/files", corsMiddleware(http.HandlerFunc(client.filesHandler)))
-		mux.Handle("/metadata", corsMiddleware(http.HandlerFunc(client.metadataHandler)))
-		mux.Handle("/status", corsMiddleware(http.HandlerFunc(client.statusHandler)))
-		mux.Handle("/restart", corsMiddleware(http.HandlerFunc(client.restartHandler)))
-		mux.Handle("/download-subtitle", corsMiddleware(http.HandlerFunc(client.downloadSubtitleHandler)))
-		mux.Handle("/fetch-torrent-url", corsMiddleware(http.HandlerFunc(client.fetchTorrentURLHandler)))
-
-		mux.Handle("/stream-vtt", corsMiddleware(http.HandlerFunc(client.streamVttHandler)))
-		mux.Handle("/extract-subtitles", corsMiddleware(http.HandlerFunc(client.extractSubtitlesHandler)))
-		mux.Handle("/subtitles", corsMiddleware(http.HandlerFunc(client.serveSubtitleFileHandler)))
+		mux.Handle("/stream", cors(http.HandlerFunc(client.streamHandler)))
+		mux.Handle("/download", cors(http.HandlerFunc(client.downloadHandler)))
+		mux.Handle("/files", cors(gzipMiddleware(http.HandlerFunc(client.filesHandler))))
+		mux.Handle("/metadata", cors(gzipMiddleware(http.HandlerFunc(client.metadataHandler))))
+		mux.Handle("/add", cors(gzipMiddleware(http.HandlerFunc(client.addHandler))))
+		mux.Handle("/metadata/batch", cors(gzipMiddleware(http.HandlerFunc(client.batchMetadataHandler))))
+		mux.Handle("/playlist", cors(http.HandlerFunc(client.playlistHandler)))
+		mux.Handle("/status", cors(gzipMiddleware(http.HandlerFunc(client.statusHandler))))
+		mux.Handle("/pause", cors(http.HandlerFunc(client.pauseHandler)))
+		mux.Handle("/resume", cors(http.HandlerFunc(client.resumeHandler)))
+		mux.Handle("/purge", cors(gzipMiddleware(http.HandlerFunc(client.purgeHandler))))
+		mux.Handle("/cache/clear", cors(gzipMiddleware(http.HandlerFunc(client.cacheClearHandler))))
+		mux.Handle("/restart", cors(http.HandlerFunc(client.restartHandler)))
+		mux.Handle("/shutdown", cors(http.HandlerFunc(client.shutdownHandler)))
+		mux.Handle("/config", cors(http.HandlerFunc(client.configHandler)))
+		mux.Handle("/stats", cors(gzipMiddleware(http.HandlerFunc(client.statsHandler))))
+		mux.Handle("/version", cors(http.HandlerFunc(versionHandler)))
+		if *enableMetrics {
+			mux.Handle("/metrics", promhttp.Handler())
+		}
+		mux.Handle("/download-subtitle", cors(http.HandlerFunc(client.downloadSubtitleHandler)))
+		mux.Handle("/fetch-torrent-url", cors(http.HandlerFunc(client.fetchTorrentURLHandler)))
+		mux.Handle("/validate", cors(gzipMiddleware(http.HandlerFunc(client.validateHandler))))
+		mux.Handle("/search", cors(gzipMiddleware(http.HandlerFunc(client.searchHandler))))
+
+		mux.Handle("/stream-vtt", cors(gzipMiddleware(http.HandlerFunc(client.streamVttHandler))))
+		mux.Handle("/probe", cors(gzipMiddleware(http.HandlerFunc(client.probeHandler))))
+		mux.Handle("/chapters", cors(gzipMiddleware(http.HandlerFunc(client.chaptersHandler))))
+		mux.Handle("/transcode", cors(http.HandlerFunc(client.transcodeHandler)))
+		mux.Handle("/thumbnail", cors(http.HandlerFunc(client.thumbnailHandler)))
+		mux.Handle("/extract-subtitles", cors(http.HandlerFunc(client.extractSubtitlesHandler)))
+		mux.Handle("/extract-status", cors(gzipMiddleware(http.HandlerFunc(client.extractStatusHandler))))
+		mux.Handle("/extract-logs", cors(http.HandlerFunc(client.extractLogsHandler)))
+		mux.Handle("/subtitles", cors(gzipMiddleware(http.HandlerFunc(client.serveSubtitleFileHandler))))
+
+		if *enableDLNA {
+			mux.Handle(dlnaDescriptionPath, dlnaDeviceDescription(dlnaUUID, dlnaFriendlyName))
+			mux.HandleFunc("/dlna/ContentDirectory.xml", dlnaSCPDHandler)
+			mux.HandleFunc("/dlna/control/ContentDirectory", client.dlnaControlHandler)
+			mux.HandleFunc("/dlna/event/ContentDirectory", dlnaEventHandler)
+		}
 
 		// Create a sub-filesystem for jassub_dist
 		jassubFS, err := fs.Sub(staticFiles, "jassub_dist")
@@ -1103,33 +6937,72 @@ func main() {
 		// Serve static files
 		mux.Handle("/", http.FileServer(http.FS(staticFiles)))
 
-		server := &http.Server{Addr: ":" + strconv.Itoa(*port), Handler: mux}
+		if *authToken != "" {
+			slog.Info("Bearer-token authentication is enabled for all endpoints")
+		}
+		// /health stays reachable without credentials; everything else goes through auth.
+		rootMux := http.NewServeMux()
+		rootMux.HandleFunc("/health", client.healthHandler)
+		rootMux.Handle("/", authMiddleware(*authToken, mux))
+
+		server := &http.Server{Addr: net.JoinHostPort(*listenAddr, strconv.Itoa(*port)), Handler: rootMux, Protocols: serverProtocols(*enableH2C), HTTP2: serverHTTP2Config(*http2MaxStreams, *http2Window)}
 
+		bindAddr := server.Addr
+		if *listenAddr == "" {
+			bindAddr += " (all interfaces)"
+		}
 		go func() {
-			log.Printf("Server listening on port %d", *port)
-			log.Println("Available endpoints: /stream, /files, /metadata, /status, /restart")
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Info("Available endpoints: /stream, /files, /metadata, /status, /config, /health, /restart, /shutdown")
+			var err error
+			if useTLS {
+				slog.Info("Server listening (HTTPS)", "addr", bindAddr)
+				err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+			} else {
+				slog.Info("Server listening", "addr", bindAddr)
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("HTTP server error: %v", err)
 			}
 		}()
 
 		select {
 		case <-sigChan:
-			log.Println("Hard termination triggered by signal. Killing process.")
-			os.Remove(pidFile)
+			slog.Info("Hard termination triggered by signal. Killing process.")
+			if ssdp != nil {
+				ssdp.byebye()
+			}
+			removePIDFile()
 			os.Exit(0)
-		case <-restartChan:
-			log.Println("Restarting server...")
-			client.Close()
-			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+		case restart := <-restartChan:
+			if restart {
+				slog.Info("Restarting server")
+			} else {
+				slog.Info("Shutting down server")
+			}
+			// Stop accepting requests and let open streams finish before the torrent
+			// client is closed, so their torrents aren't dropped mid-response.
+			if streams := client.activeStreamCount(); streams > 0 {
+				slog.Info("Waiting for active streams to finish", "streams", streams, "timeout", *shutdownTimeout)
+			}
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 			defer shutdownCancel()
 			if err := server.Shutdown(shutdownCtx); err != nil {
-				log.Printf("Server shutdown error: %v", err)
+				slog.Warn("Server shutdown timed out, closing remaining connections", "streams", client.activeStreamCount(), "err", err)
+				server.Close()
 			} else {
-				log.Println("Server shut down gracefully.")
+				slog.Info("Server shut down gracefully")
 			}
+			client.Close()
 			cancel()
-			log.Println("Waiting a moment before restarting...")
+			if !restart {
+				if ssdp != nil {
+					ssdp.byebye()
+				}
+				removePIDFile()
+				os.Exit(0)
+			}
+			slog.Info("Waiting a moment before restarting")
 			time.Sleep(1 * time.Second)
 			// Continue to the next iteration of the loop
 		}
@@ -0,0 +1,1402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+)
+
+// testFile is a file of a torrent built by writeTestTorrent.
+type testFile struct {
+	path string // Slash-separated, relative to the torrent's root directory
+	size int64  // Length of random content, used when data is nil
+	data []byte
+}
+
+// newTestClient starts a TorrentClient on a temporary download directory unless
+// opts names one. It is closed when the test ends.
+func newTestClient(t testing.TB, opts Options) *TorrentClient {
+	t.Helper()
+	if opts.DownloadDir == "" {
+		opts.DownloadDir = t.TempDir()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	tc, err := NewTorrentClient(ctx, opts, make(chan bool, 1))
+	if err != nil {
+		cancel()
+		t.Fatalf("NewTorrentClient: %v", err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		tc.Close()
+	})
+	return tc
+}
+
+// writeTestTorrent writes files with random content under dir/name and returns
+// the metainfo of a multi-file torrent holding them in the given order.
+func writeTestTorrent(t testing.TB, dir, name string, files []testFile) *metainfo.MetaInfo {
+	t.Helper()
+	info := metainfo.Info{Name: name, PieceLength: 16 << 10}
+	for _, f := range files {
+		path := filepath.Join(dir, name, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		data := f.data
+		if data == nil {
+			data = make([]byte, f.size)
+			rand.Read(data)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		info.Files = append(info.Files, metainfo.FileInfo{Path: strings.Split(f.path, "/"), Length: int64(len(data))})
+	}
+	err := info.GeneratePieces(func(fi metainfo.FileInfo) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(append([]string{dir, name}, fi.Path...)...))
+	})
+	if err != nil {
+		t.Fatalf("GeneratePieces: %v", err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &metainfo.MetaInfo{InfoBytes: infoBytes}
+}
+
+// persistTestTorrent saves mi's metainfo to tc's database, as a swarm fetch
+// would, and returns a magnet link for it.
+func persistTestTorrent(t testing.TB, tc *TorrentClient, mi *metainfo.MetaInfo) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := mi.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	infoHash := mi.HashInfoBytes().HexString()
+	if err := tc.putMetainfo(infoHash, buf.Bytes()); err != nil {
+		t.Fatalf("putMetainfo: %v", err)
+	}
+	return "magnet:?xt=urn:btih:" + infoHash
+}
+
+// verifyTestTorrent adds the torrent behind magnetLink and waits until its
+// data on disk has been verified, so it can be read without peers.
+func verifyTestTorrent(t testing.TB, tc *TorrentClient, magnetLink string) *torrent.Torrent {
+	t.Helper()
+	tor, err := tc.getTorrentFromMagnet(magnetLink, tc.downloadDir)
+	if err != nil {
+		t.Fatalf("getTorrentFromMagnet: %v", err)
+	}
+	tor.VerifyData()
+	deadline := time.Now().Add(10 * time.Second)
+	for tor.BytesMissing() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("torrent incomplete after verification: %d bytes missing", tor.BytesMissing())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return tor
+}
+
+func TestNormalizeMagnetLinkV2(t *testing.T) {
+	v1 := "0123456789abcdef0123456789abcdef01234567"
+	v2 := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	tests := []struct {
+		name, in, want string
+	}{
+		{"bare v1", strings.ToUpper(v1), "magnet:?xt=urn:btih:" + v1},
+		{"bare v2", strings.ToUpper(v2), "magnet:?xt=urn:btmh:1220" + v2},
+		{"v2 magnet", "magnet:?xt=urn:btmh:1220" + v2, "magnet:?xt=urn:btmh:1220" + v2},
+		{"hybrid magnet", "magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2, "magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2},
+	}
+	for _, tt := range tests {
+		got, err := normalizeMagnetLink(tt.in)
+		if err != nil {
+			t.Errorf("%s: normalizeMagnetLink(%q) error: %v", tt.name, tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: normalizeMagnetLink(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMagnetKeyV2AndHybrid(t *testing.T) {
+	v1 := "0123456789abcdef0123456789abcdef01234567"
+	v2 := "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+	tests := []struct {
+		name, magnet, want string
+	}{
+		// v2-only torrents are keyed by the truncated v2 infohash, as the client does.
+		{"v2", "magnet:?xt=urn:btmh:1220" + v2, v2[:40]},
+		// Hybrid torrents are keyed by their v1 infohash, whichever xt comes first.
+		{"hybrid", "magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2, v1},
+		{"hybrid, v2 first", "magnet:?xt=urn:btmh:1220" + v2 + "&xt=urn:btih:" + v1, v1},
+	}
+	for _, tt := range tests {
+		m, err := metainfo.ParseMagnetV2Uri(tt.magnet)
+		if err != nil {
+			t.Fatalf("%s: ParseMagnetV2Uri: %v", tt.name, err)
+		}
+		if got := magnetKey(m); got != tt.want {
+			t.Errorf("%s: magnetKey = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A hybrid torrent already active under its v1 infohash must be found, not
+// added again, when requested by a v2 or hybrid magnet.
+func TestGetTorrentFromMagnetV2Alias(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	mi := writeTestTorrent(t, tc.downloadDir, "show", []testFile{{path: "episode.mkv", size: 64 << 10}})
+	v1Magnet := persistTestTorrent(t, tc, mi)
+	v1 := mi.HashInfoBytes().HexString()
+	first, err := tc.getTorrentFromMagnet(v1Magnet, tc.downloadDir)
+	if err != nil {
+		t.Fatalf("getTorrentFromMagnet(v1): %v", err)
+	}
+
+	// Recorded when the info of a hybrid torrent fetched by v2 arrives.
+	v2 := strings.Repeat("ab", 32)
+	tc.putInfoHashAlias(v2[:40], v1)
+
+	for _, magnet := range []string{
+		"magnet:?xt=urn:btmh:1220" + v2,
+		"magnet:?xt=urn:btih:" + v1 + "&xt=urn:btmh:1220" + v2,
+	} {
+		got, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir)
+		if err != nil {
+			t.Fatalf("getTorrentFromMagnet(%s): %v", magnet, err)
+		}
+		if got != first {
+			t.Errorf("getTorrentFromMagnet(%s) returned a different torrent", magnet)
+		}
+	}
+	if n := tc.cache.Len(); n != 1 {
+		t.Errorf("cache holds %d torrents, want 1", n)
+	}
+	if n := tc.torrentsAdded.Load(); n != 1 {
+		t.Errorf("torrents added = %d, want 1", n)
+	}
+	if n := len(tc.client.Torrents()); n != 1 {
+		t.Errorf("client runs %d torrents, want 1", n)
+	}
+}
+
+// Ten simultaneous cache misses for the same torrent run a single add.
+func TestSharedAddRunsOneAdd(t *testing.T) {
+	tc := &TorrentClient{}
+	var adds atomic.Int32
+	add := func() (*torrent.Torrent, error) {
+		adds.Add(1)
+		time.Sleep(200 * time.Millisecond) // Keep the add in flight while the others arrive
+		return &torrent.Torrent{}, nil
+	}
+
+	const requests = 10
+	results := make([]*torrent.Torrent, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tor, _, err := tc.sharedAdd("0123456789abcdef0123456789abcdef01234567", add)
+			if err != nil {
+				t.Errorf("sharedAdd: %v", err)
+			}
+			results[i] = tor
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := adds.Load(); n != 1 {
+		t.Fatalf("add ran %d times, want 1", n)
+	}
+	for i, tor := range results {
+		if tor != results[0] {
+			t.Errorf("request %d got a different torrent", i)
+		}
+	}
+}
+
+func TestGetTorrentFromMagnetConcurrentMisses(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "movie", []testFile{{path: "movie.mkv", size: 64 << 10}}))
+
+	const requests = 10
+	results := make([]*torrent.Torrent, requests)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tor, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir)
+			if err != nil {
+				t.Errorf("getTorrentFromMagnet: %v", err)
+			}
+			results[i] = tor
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if n := tc.torrentsAdded.Load(); n != 1 {
+		t.Errorf("torrents added = %d, want 1", n)
+	}
+	for i, tor := range results {
+		if tor != results[0] {
+			t.Errorf("request %d got a different torrent", i)
+		}
+	}
+}
+
+func TestExtractionFilePath(t *testing.T) {
+	dataDir := filepath.Join(string(filepath.Separator)+"data", "dl")
+	tests := []struct {
+		name, file string
+		ok         bool
+	}{
+		{"subtitle", "0123456789abcdef0123456789abcdef01234567_0_0.ass", true},
+		{"log", "0123456789abcdef0123456789abcdef01234567_0_0.log", true},
+		{"dots inside name", "..dl2_0_0.log", true},
+		{"parent", "..", false},
+		{"current", ".", false},
+		{"parent traversal", "../etc/passwd", false},
+		{"nested traversal", "sub/../../etc/passwd", false},
+		{"absolute", "/etc/passwd", false},
+		{"backslash traversal", `..\secret.log`, false},
+		{"backslash", `sub\file.log`, false},
+		// dataDir is a string prefix of its sibling dataDir2.
+		{"prefix collision", "../dl2/secret.log", false},
+	}
+	for _, tt := range tests {
+		got, ok := extractionFilePath(dataDir, tt.file)
+		if ok != tt.ok {
+			t.Errorf("%s: extractionFilePath(%q) ok = %v, want %v", tt.name, tt.file, ok, tt.ok)
+			continue
+		}
+		if ok && got != filepath.Join(dataDir, tt.file) {
+			t.Errorf("%s: extractionFilePath(%q) = %q, want it inside %q", tt.name, tt.file, got, dataDir)
+		}
+	}
+}
+
+func TestServeSubtitleFileRejectsSiblingDir(t *testing.T) {
+	parent := t.TempDir()
+	dataDir := filepath.Join(parent, "dl")
+	sibling := filepath.Join(parent, "dl2")
+	for _, dir := range []string{dataDir, sibling} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(sibling, "secret.log"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tc := &TorrentClient{downloadDir: dataDir}
+
+	for _, file := range []string{"../dl2/secret.log", filepath.Join(sibling, "secret.log")} {
+		rec := httptest.NewRecorder()
+		tc.serveSubtitleFileHandler(rec, httptest.NewRequest(http.MethodGet, "/subtitles?file="+url.QueryEscape(file), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("file=%s: status %d, want %d", file, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFetchTorrentURLBlocksLoopback(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("d4:infod4:name1:xee"))
+	}))
+	defer srv.Close()
+	tc := &TorrentClient{fetchClient: newFetchClient(false)}
+
+	body := strings.NewReader(`{"url":"` + srv.URL + `/file.torrent"}`)
+	rec := httptest.NewRecorder()
+	tc.fetchTorrentURLHandler(rec, httptest.NewRequest(http.MethodPost, "/fetch-torrent-url", body))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("loopback server was hit %d times", n)
+	}
+
+	// -allow-private-fetch lifts the restriction.
+	resp, err := newFetchClient(true).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("fetch with private addresses allowed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFetchClientBlocksRedirectToPrivateAddress(t *testing.T) {
+	var hits atomic.Int32
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer internal.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(internal.URL+"/admin", http.StatusFound))
+	defer redirector.Close()
+
+	// Stand in for a public host that redirects: only its dial skips the
+	// address check, so the redirect target is checked as in production.
+	client := newFetchClient(false)
+	transport := client.Transport.(*http.Transport)
+	guardedDial := transport.DialContext
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "public.example:80" {
+			return (&net.Dialer{}).DialContext(ctx, network, redirector.Listener.Addr().String())
+		}
+		return guardedDial(ctx, network, addr)
+	}
+
+	_, err := client.Get("http://public.example/file.torrent")
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("redirect to %s: err = %v, want %v", internal.URL, err, errBlockedAddress)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("private redirect target was hit %d times", n)
+	}
+}
+
+func TestSrtTextToVttTags(t *testing.T) {
+	tests := []struct {
+		in, text, settings string
+	}{
+		{`{\an8}Top`, "Top", "line:0"},
+		{`{\an1}<b>Left</b>`, "<b>Left</b>", "align:start"},
+		{`{\an5}Middle`, "Middle", "line:50%"},
+		{`{\an2}Default`, "Default", ""},
+		{`<i>Italic</i>`, "<i>Italic</i>", ""},
+		{`<I>Upper</I>`, "<i>Upper</i>", ""},
+		{`<font color="#ff0000">Red</font>`, "Red", ""},
+		{`<b><font face="Arial">Both</font></b>`, "<b>Both</b>", ""},
+		{`{\i1}Over{\i0}`, "<i>Over</i>", ""},
+		{`{\b1}B{\b0} {\u1}U{\u0}`, "<b>B</b> <u>U</u>", ""},
+		{`{\pos(10,20)}Positioned`, "Positioned", ""},
+		{`a < b & c > d`, "a &lt; b &amp; c &gt; d", ""},
+		{`Tom &amp; Jerry`, "Tom &amp; Jerry", ""},
+	}
+	for _, tt := range tests {
+		text, settings := srtTextToVtt(tt.in)
+		if text != tt.text || settings != tt.settings {
+			t.Errorf("srtTextToVtt(%q) = %q, %q; want %q, %q", tt.in, text, settings, tt.text, tt.settings)
+		}
+	}
+}
+
+func TestSrtToVttTags(t *testing.T) {
+	srt := "1\n00:00:01,000 --> 00:00:02,500\n{\\an8}<font color=\"red\">Hi</font>\n\n" +
+		"2\n00:00:03,000 --> 00:00:04,000\n<i>Bye</i>\n"
+	want := "WEBVTT\n\n" +
+		"00:00:01.000 --> 00:00:02.500 line:0\nHi\n\n" +
+		"00:00:03.000 --> 00:00:04.000\n<i>Bye</i>\n\n"
+	if got := srtToVtt(srt); got != want {
+		t.Errorf("srtToVtt =\n%q\nwant\n%q", got, want)
+	}
+}
+
+// utf16Bytes encodes s as UTF-16 with a byte order mark.
+func utf16Bytes(s string, bigEndian bool) []byte {
+	units := utf16.Encode([]rune("\ufeff" + s))
+	b := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		if bigEndian {
+			b = append(b, byte(u>>8), byte(u))
+		} else {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	return b
+}
+
+func TestDecodeSubtitleText(t *testing.T) {
+	text := "1\r\n00:00:01,000 --> 00:00:02,000\r\nCafé ♪\r\n"
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"UTF-8", []byte(text)},
+		{"UTF-8 with BOM", append([]byte("\ufeff"), text...)},
+		{"UTF-16 LE", utf16Bytes(text, false)},
+		{"UTF-16 BE", utf16Bytes(text, true)},
+	}
+	for _, tt := range tests {
+		if got := decodeSubtitleText(tt.in); got != text {
+			t.Errorf("%s: decodeSubtitleText = %q, want %q", tt.name, got, text)
+		}
+	}
+}
+
+func TestSrtToVttMixedNewlines(t *testing.T) {
+	want := "WEBVTT\n\n" +
+		"00:00:01.000 --> 00:00:02.000\nFirst\nline two\n\n" +
+		"00:00:03.000 --> 00:00:04.000\nSecond\n\n" +
+		"00:00:05.000 --> 00:00:06.000\nThird\n\n"
+	srt := "\ufeff1\r\n00:00:01,000 --> 00:00:02,000\r\nFirst\nline two\r\n\r\n" +
+		"2\n00:00:03,000 --> 00:00:04,000\rSecond\r\r" +
+		"3\r\n00:00:05,000 --> 00:00:06,000\nThird\n\n\n"
+	if got := srtToVtt(srt); got != want {
+		t.Errorf("srtToVtt =\n%q\nwant\n%q", got, want)
+	}
+}
+
+// format=srt returns UTF-16 subtitles as the UTF-8 text its header declares.
+func TestDownloadSubtitleSrtDecodesUTF16(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	text := "1\r\n00:00:01,000 --> 00:00:02,000\r\nCafé ♪\r\n"
+	mi := writeTestTorrent(t, tc.downloadDir, "film", []testFile{
+		{path: "film.mkv", size: 64 << 10},
+		{path: "film.srt", data: utf16Bytes(text, false)},
+	})
+	magnet := persistTestTorrent(t, tc, mi)
+	verifyTestTorrent(t, tc, magnet)
+
+	rec := httptest.NewRecorder()
+	target := "/download-subtitle?format=srt&url=" + url.QueryEscape(magnet) + "&filePath=" + url.QueryEscape("film.srt")
+	tc.downloadSubtitleHandler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Body.String(); got != text {
+		t.Errorf("body = %q, want %q", got, text)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestGetContentType(t *testing.T) {
+	tests := []struct {
+		file, want string
+	}{
+		{"movie.mp4", "video/mp4"},
+		{"movie.m4v", "video/mp4"},
+		{"Movie.MKV", "video/x-matroska"},
+		{"clip.webm", "video/webm"},
+		{"old.avi", "video/x-msvideo"},
+		{"phone.mov", "video/quicktime"},
+		{"clip.ogv", "video/ogg"},
+		{"broadcast.ts", "video/mp2t"},
+		{"bluray.m2ts", "video/mp2t"},
+		{"win.wmv", "video/x-ms-wmv"},
+		{"flash.flv", "video/x-flv"},
+		{"song.mp3", "audio/mpeg"},
+		{"album/track.flac", "audio/flac"},
+		{"song.m4a", "audio/mp4"},
+		{"book.m4b", "audio/mp4"},
+		{"raw.aac", "audio/aac"},
+		{"vorbis.ogg", "audio/ogg"},
+		{"vorbis.oga", "audio/ogg"},
+		{"voice.opus", "audio/opus"},
+		{"pcm.wav", "audio/wav"},
+		{"audio.mka", "audio/x-matroska"},
+		// Not in the switch: mime.TypeByExtension's built-in table.
+		{"cover.png", "image/png"},
+		// Unknown extensions and files without one are served as raw bytes.
+		{"data.unknownext", "application/octet-stream"},
+		{"README", "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		if got := getContentType(tt.file); got != tt.want {
+			t.Errorf("getContentType(%q) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
+
+// getStatus calls statusHandler for magnetLink with extra query parameters.
+func getStatus(t *testing.T, tc *TorrentClient, magnetLink, query string) (StatusInfo, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	tc.statusHandler(rec, httptest.NewRequest(http.MethodGet, "/status?url="+url.QueryEscape(magnetLink)+query, nil))
+	var status StatusInfo
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("decoding status: %v", err)
+		}
+	}
+	return status, rec.Code
+}
+
+// Re-opening a torrent whose data is already on disk verifies it and reports
+// 100% without downloading anything.
+func TestReaddCompleteTorrentReportsCompletion(t *testing.T) {
+	tc := newTestClient(t, Options{VerifyOnReadd: true})
+	mi := writeTestTorrent(t, tc.downloadDir, "season", []testFile{
+		{path: "e01.mkv", size: 256 << 10},
+		{path: "e02.mkv", size: 256 << 10},
+	})
+	magnet := persistTestTorrent(t, tc, mi)
+	if _, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir); err != nil {
+		t.Fatalf("getTorrentFromMagnet: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, code := getStatus(t, tc, magnet, "")
+		if code != http.StatusOK {
+			t.Fatalf("status code %d", code)
+		}
+		if !status.Verifying && status.PercentageCompleted == 100 {
+			if status.BytesCompleted != status.TotalBytes {
+				t.Errorf("bytesCompleted = %d, want %d", status.BytesCompleted, status.TotalBytes)
+			}
+			for _, f := range status.Files {
+				if f.PercentageCompleted != 100 {
+					t.Errorf("file %s is %.1f%% complete, want 100%%", f.Path, f.PercentageCompleted)
+				}
+			}
+			if status.DownloadedBytes != 0 {
+				t.Errorf("downloaded %d bytes from peers, want 0", status.DownloadedBytes)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not reported complete after re-add: verifying=%v, %.1f%%", status.Verifying, status.PercentageCompleted)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestEmptyFileListRejected(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	// A multi-file torrent whose "files" list is empty.
+	mi := &metainfo.MetaInfo{InfoBytes: []byte("d5:filesle4:name5:empty12:piece lengthi16384e6:pieces0:e")}
+	magnet := persistTestTorrent(t, tc, mi)
+
+	handlers := []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/files", tc.filesHandler},
+		{"/metadata", tc.metadataHandler},
+		{"/stream", tc.streamHandler},
+		{"/status", tc.statusHandler}, // Needs the torrent active, which /stream does
+		{"/playlist", tc.playlistHandler},
+	}
+	for _, h := range handlers {
+		rec := httptest.NewRecorder()
+		h.handler(rec, httptest.NewRequest(http.MethodGet, h.path+"?index=0&url="+url.QueryEscape(magnet), nil))
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), errNoFiles.Error()) {
+			t.Errorf("%s: status %d %s, want %d %q", h.path, rec.Code, strings.TrimSpace(rec.Body.String()), http.StatusUnprocessableEntity, errNoFiles)
+		}
+	}
+}
+
+// A poll inside the half-second sampling window reports the last speed
+// instead of 0.
+func TestStatusSpeedStableBetweenSamples(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "movie", []testFile{{path: "movie.mkv", size: 1 << 20}}))
+	tor := verifyTestTorrent(t, tc, magnet)
+
+	// Pretend the last sample was taken a second ago, before 512 KiB arrived.
+	entry := tc.cacheEntryFor(tor)
+	entry.mu.Lock()
+	entry.prevReadTime = time.Now().Add(-time.Second)
+	entry.prevBytesRead = tor.BytesCompleted() - 512<<10
+	entry.mu.Unlock()
+
+	first, code := getStatus(t, tc, magnet, "")
+	if code != http.StatusOK {
+		t.Fatalf("first status: code %d", code)
+	}
+	second, code := getStatus(t, tc, magnet, "")
+	if code != http.StatusOK {
+		t.Fatalf("second status: code %d", code)
+	}
+	if first.DownloadSpeedBps <= 0 {
+		t.Fatalf("first speed = %v, want > 0", first.DownloadSpeedBps)
+	}
+	if second.DownloadSpeedBps != first.DownloadSpeedBps {
+		t.Errorf("second speed = %v, want %v", second.DownloadSpeedBps, first.DownloadSpeedBps)
+	}
+	if second.DownloadSpeedHuman != first.DownloadSpeedHuman {
+		t.Errorf("second speed = %q, want %q", second.DownloadSpeedHuman, first.DownloadSpeedHuman)
+	}
+}
+
+// activeStreams returns the number of open streams of the torrent behind magnetLink.
+func activeStreams(t *testing.T, tc *TorrentClient, magnetLink string) int {
+	t.Helper()
+	key, err := tc.infoHashKey(magnetLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, ok := tc.cache.Peek(key)
+	if !ok {
+		return 0
+	}
+	entry := val.(*cacheEntry)
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	return entry.activeStreams
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxStreamsPerTorrent(t *testing.T) {
+	const limit = 2
+	tc := newTestClient(t, Options{MaxStreamsPerTorrent: limit})
+	mi := writeTestTorrent(t, tc.downloadDir, "movie", []testFile{{path: "movie.mkv", size: 256 << 10}})
+	magnet := persistTestTorrent(t, tc, mi)
+	// Without the data, and with no peers, streams stay open waiting for it.
+	if err := os.RemoveAll(filepath.Join(tc.downloadDir, "movie")); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+	defer srv.Close()
+	streamURL := srv.URL + "/stream?index=0&url=" + url.QueryEscape(magnet)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for range limit {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}()
+	}
+	waitFor(t, "streams to open", func() bool { return activeStreams(t, tc, magnet) == limit })
+
+	resp, err := http.Get(streamURL)
+	if err != nil {
+		t.Fatalf("stream %d: %v", limit+1, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("stream %d: status %d, want %d", limit+1, resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	// Disconnecting frees the slots.
+	cancel()
+	wg.Wait()
+	waitFor(t, "streams to close", func() bool { return activeStreams(t, tc, magnet) == 0 })
+}
+
+// path selects the same file whatever its index in the torrent.
+func TestRequestedFileByPath(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	layouts := [][]testFile{
+		{{path: "Extras/interview.mkv", size: 48 << 10}, {path: "main.mkv", size: 32 << 10}, {path: "notes.txt", size: 1 << 10}},
+		{{path: "notes.txt", size: 1 << 10}, {path: "main.mkv", size: 32 << 10}, {path: "Extras/interview.mkv", size: 48 << 10}},
+	}
+	for i, files := range layouts {
+		magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, fmt.Sprintf("release%d", i), files))
+		tor, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir)
+		if err != nil {
+			t.Fatalf("layout %d: getTorrentFromMagnet: %v", i, err)
+		}
+		for _, path := range []string{"main.mkv", "Extras/interview.mkv", "notes.txt"} {
+			r := httptest.NewRequest(http.MethodGet, "/stream?path="+url.QueryEscape(path), nil)
+			file, index, err := tc.requestedFile(tor, r)
+			if err != nil {
+				t.Fatalf("layout %d: path %s: %v", i, path, err)
+			}
+			if file.DisplayPath() != path || tor.Files()[index] != file {
+				t.Errorf("layout %d: path %s selected %s (index %d)", i, path, file.DisplayPath(), index)
+			}
+		}
+
+		// path wins over index, and /status sizes the file it selects.
+		status, code := getStatus(t, tc, magnet, "&index=0&path="+url.QueryEscape("main.mkv"))
+		if code != http.StatusOK {
+			t.Fatalf("layout %d: status code %d", i, code)
+		}
+		if status.StreamingFileSize != 32<<10 {
+			t.Errorf("layout %d: streamingFileSize = %d, want %d", i, status.StreamingFileSize, 32<<10)
+		}
+	}
+}
+
+// With -no-persist there is no LotusDB; a torrent whose info came from the
+// swarm still streams, and nothing but the data is written to disk.
+func TestNoPersistStreams(t *testing.T) {
+	tc := newTestClient(t, Options{NoPersist: true})
+	if tc.db != nil {
+		t.Fatal("NoPersist opened a metadata database")
+	}
+	data := make([]byte, 40<<10)
+	rand.Read(data)
+	mi := writeTestTorrent(t, tc.downloadDir, "clip", []testFile{{path: "clip.mp4", data: data}})
+	// Stand in for the swarm: the client knows the info, nothing is persisted.
+	if _, err := tc.addTorrentSpec(mi, tc.downloadDir); err != nil {
+		t.Fatalf("addTorrentSpec: %v", err)
+	}
+	magnet := "magnet:?xt=urn:btih:" + mi.HashInfoBytes().HexString()
+	verifyTestTorrent(t, tc, magnet)
+
+	srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream?index=0&url=" + url.QueryEscape(magnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	if !bytes.Equal(body, data) {
+		t.Errorf("streamed %d bytes, want the %d-byte file", len(body), len(data))
+	}
+	if _, err := os.Stat(filepath.Join(tc.downloadDir, "lotusdb_meta")); !os.IsNotExist(err) {
+		t.Errorf("lotusdb_meta exists with -no-persist (stat: %v)", err)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	if got := fileErrorStatus(fmt.Errorf("%w: no file has the path %q", errFileNotFound, "x")); got != http.StatusNotFound {
+		t.Errorf("fileErrorStatus(errFileNotFound) = %d, want %d", got, http.StatusNotFound)
+	}
+	if got := fileErrorStatus(errors.New("invalid 'index' query parameter")); got != http.StatusBadRequest {
+		t.Errorf("fileErrorStatus(other) = %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := torrentErrorStatus(fmt.Errorf("add: %w", errInsufficientStorage)); got != http.StatusInsufficientStorage {
+		t.Errorf("torrentErrorStatus(errInsufficientStorage) = %d, want %d", got, http.StatusInsufficientStorage)
+	}
+	if got := torrentErrorStatus(errors.New("metadata timeout")); got != http.StatusInternalServerError {
+		t.Errorf("torrentErrorStatus(other) = %d, want %d", got, http.StatusInternalServerError)
+	}
+}
+
+func TestStreamErrorStatus(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "show", []testFile{{path: "ep1.mkv", size: 16 << 10}}))
+	srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+	defer srv.Close()
+
+	tests := []struct {
+		name, query string
+		want        int
+	}{
+		{"unknown path", "&path=ep2.mkv", http.StatusNotFound},
+		{"index out of range", "&index=5", http.StatusNotFound},
+		{"negative index", "&index=-1", http.StatusNotFound},
+		{"malformed index", "&index=first", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + "/stream?url=" + url.QueryEscape(magnet) + tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	// No filesystem has 100% free space, so adding a new torrent fails.
+	full := newTestClient(t, Options{MinFreePercent: 100})
+	magnet = persistTestTorrent(t, full, writeTestTorrent(t, full.downloadDir, "film", []testFile{{path: "film.mkv", size: 16 << 10}}))
+	fullSrv := httptest.NewServer(http.HandlerFunc(full.streamHandler))
+	defer fullSrv.Close()
+	resp, err := http.Get(fullSrv.URL + "/stream?url=" + url.QueryEscape(magnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("disk full: status %d, want %d", resp.StatusCode, http.StatusInsufficientStorage)
+	}
+}
+
+// A scene release lists a sample before the feature, plus an .nfo.
+var sceneRelease = []testFile{
+	{path: "Sample/movie-sample.mkv", size: 32 << 10},
+	{path: "movie.mkv", size: 160 << 10},
+	{path: "movie.nfo", size: 2 << 10},
+}
+
+func TestFilesSceneRelease(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "Movie.2024.1080p", sceneRelease))
+	rec := httptest.NewRecorder()
+	tc.filesHandler(rec, httptest.NewRequest(http.MethodGet, "/files?url="+url.QueryEscape(magnet), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		Files              []FileInfo
+		SuggestedMainIndex int `json:"suggestedMainIndex"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Files) != len(sceneRelease) {
+		t.Fatalf("got %d files, want %d", len(resp.Files), len(sceneRelease))
+	}
+	for i, want := range []bool{true, true, false} {
+		if resp.Files[i].Streamable != want {
+			t.Errorf("%s: streamable = %v, want %v", resp.Files[i].Path, resp.Files[i].Streamable, want)
+		}
+	}
+	if resp.SuggestedMainIndex != 1 {
+		t.Errorf("suggestedMainIndex = %d, want 1 (movie.mkv)", resp.SuggestedMainIndex)
+	}
+}
+
+func TestDefaultFileStrategySceneRelease(t *testing.T) {
+	tests := []struct {
+		strategy, want string
+	}{
+		{"", "movie.mkv"},
+		{FileStrategyLargest, "movie.mkv"},
+		{FileStrategyFirstVideo, "Sample/movie-sample.mkv"},
+		{FileStrategyAlphabetical, "Sample/movie-sample.mkv"},
+	}
+	for _, tt := range tests {
+		tc := newTestClient(t, Options{DefaultFileStrategy: tt.strategy})
+		magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "Movie.2024.1080p", sceneRelease))
+		tor, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir)
+		if err != nil {
+			t.Fatalf("%q: getTorrentFromMagnet: %v", tt.strategy, err)
+		}
+		if got := tc.getFileToStream(tor, -1).DisplayPath(); got != tt.want {
+			t.Errorf("%q: default file %s, want %s", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkConcurrentStreamsHTTP2 reads one large file as two concurrent
+// streams over a single HTTP/2 connection, as two players of a 4K release
+// would, with Go's HTTP/2 defaults and with the -http2-* flags at their maximum.
+func BenchmarkConcurrentStreamsHTTP2(b *testing.B) {
+	tc := newTestClient(b, Options{})
+	const size = 64 << 20
+	magnet := persistTestTorrent(b, tc, writeTestTorrent(b, tc.downloadDir, "uhd", []testFile{{path: "uhd.mkv", size: size}}))
+	verifyTestTorrent(b, tc, magnet)
+
+	for _, bc := range []struct {
+		name               string
+		maxStreams, window int
+	}{
+		{"default", 250, 0},
+		{"window=4MiB", 250, 4 << 20},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(tc.streamHandler))
+			srv.EnableHTTP2 = true
+			srv.Config.HTTP2 = serverHTTP2Config(bc.maxStreams, bc.window)
+			srv.StartTLS()
+			defer srv.Close()
+			client := srv.Client()
+			streamURL := srv.URL + "/stream?index=0&url=" + url.QueryEscape(magnet)
+
+			b.SetBytes(2 * size)
+			b.ResetTimer()
+			for range b.N {
+				var wg sync.WaitGroup
+				for range 2 {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						resp, err := client.Get(streamURL)
+						if err != nil {
+							b.Error(err)
+							return
+						}
+						defer resp.Body.Close()
+						if resp.ProtoMajor != 2 {
+							b.Errorf("served over %s, want HTTP/2", resp.Proto)
+						}
+						if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+							b.Errorf("read %d bytes (err %v), want %d", n, err, size)
+						}
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	for _, size := range []int{0, 4 << 10, 512 << 10} {
+		tc := newTestClient(t, Options{StreamBufferSize: size})
+		data := make([]byte, 100<<10)
+		rand.Read(data)
+		magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "clip", []testFile{{path: "clip.mp4", data: data}}))
+		verifyTestTorrent(t, tc, magnet)
+		srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+		for _, rng := range []struct {
+			header     string
+			start, end int
+		}{
+			{"", 0, len(data)},
+			{"bytes=5000-70000", 5000, 70001},
+		} {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/stream?index=0&url="+url.QueryEscape(magnet), nil)
+			if rng.header != "" {
+				req.Header.Set("Range", rng.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, data[rng.start:rng.end]) {
+				t.Errorf("buffer %d, range %q: got %d bytes, want bytes %d-%d", size, rng.header, len(body), rng.start, rng.end-1)
+			}
+		}
+		srv.Close()
+	}
+}
+
+// BenchmarkStreamBufferSize streams a file over HTTP/1.1 through net/http's
+// copy buffers and through pooled -stream-buffer-size buffers.
+func BenchmarkStreamBufferSize(b *testing.B) {
+	const size = 32 << 20
+	for _, bufferSize := range []int{0, 512 << 10} {
+		b.Run(fmt.Sprintf("buffer=%d", bufferSize), func(b *testing.B) {
+			tc := newTestClient(b, Options{StreamBufferSize: bufferSize})
+			magnet := persistTestTorrent(b, tc, writeTestTorrent(b, tc.downloadDir, "uhd", []testFile{{path: "uhd.mkv", size: size}}))
+			verifyTestTorrent(b, tc, magnet)
+			srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+			defer srv.Close()
+			streamURL := srv.URL + "/stream?index=0&url=" + url.QueryEscape(magnet)
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				resp, err := http.Get(streamURL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("read %d bytes (err %v), want %d", n, err, size)
+				}
+			}
+		})
+	}
+}
+
+// ffmpeg reads from the internal loopback server over plain HTTP, whatever
+// address, port and TLS setup the public server uses.
+func TestInternalStreamURL(t *testing.T) {
+	tc := newTestClient(t, Options{Port: 8443})
+	if err := tc.startInternalServer(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 20<<10)
+	rand.Read(data)
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "clip", []testFile{{path: "clip.mkv", data: data}}))
+	verifyTestTorrent(t, tc, magnet)
+
+	streamURL := tc.internalStreamURL(magnet, 0)
+	u, err := url.Parse(streamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "http" || u.Hostname() != "127.0.0.1" || u.Port() == "" || u.Port() == "8443" {
+		t.Fatalf("internalStreamURL = %s, want http://127.0.0.1:<internal port>/...", streamURL)
+	}
+	if u.Query().Get("url") != magnet || u.Query().Get("index") != "0" {
+		t.Errorf("internalStreamURL = %s does not select the file", streamURL)
+	}
+	resp, err := http.Get(streamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("internal stream: status %d, %d bytes; want 200 with the %d-byte file", resp.StatusCode, len(body), len(data))
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, filename := range []string{
+		"movie.mkv",
+		"My Movie (2024).mkv",
+		`say "hi" \ bye.srt`,
+		"100% done+more.mp4",
+		"Amélie 映画.mkv",
+		"semi;colon=eq.mkv",
+	} {
+		header := contentDisposition("attachment", filename)
+		dispositionType, params, err := mime.ParseMediaType(header)
+		if err != nil {
+			t.Errorf("%q: %s does not parse: %v", filename, header, err)
+			continue
+		}
+		if dispositionType != "attachment" || params["filename"] != filename {
+			t.Errorf("%q: %s parses as %s, filename %q", filename, header, dispositionType, params["filename"])
+		}
+	}
+	if got, want := contentDisposition("inline", "My Movie.mkv"), `inline; filename="My Movie.mkv"`; got != want {
+		t.Errorf("contentDisposition = %s, want %s", got, want)
+	}
+}
+
+// Each stream moves only its own seek window; a second player's window on the
+// same torrent keeps its priority until that stream ends.
+func TestSeekWindowPerStream(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	const pieceLength = 16 << 10
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "movie", []testFile{{path: "movie.mkv", size: 64 * pieceLength}}))
+	// Without the data no piece is complete, so priorities are reported as set.
+	if err := os.RemoveAll(filepath.Join(tc.downloadDir, "movie")); err != nil {
+		t.Fatal(err)
+	}
+	tor, err := tc.getTorrentFromMagnet(magnet, tc.downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Priorities read as none until the initial check has found every piece missing.
+	waitFor(t, "pieces to be checked", func() bool {
+		for i := range tor.NumPieces() {
+			if ps := tor.PieceState(i); !ps.Ok || ps.Checking {
+				return false
+			}
+		}
+		return true
+	})
+	file := tor.Files()[0]
+	priority := func(piece int) torrent.PiecePriority { return tor.PieceState(piece).Priority }
+	a := &seekPrioritizingReader{tc: tc, file: file, window: 4 * pieceLength}
+	b := &seekPrioritizingReader{tc: tc, file: file, window: 4 * pieceLength}
+
+	tc.prioritizeSeekWindow(a, file, 10*pieceLength, a.window) // pieces 10-13
+	tc.prioritizeSeekWindow(b, file, 30*pieceLength, b.window) // pieces 30-33
+	tc.prioritizeSeekWindow(a, file, 12*pieceLength, a.window) // pieces 12-15
+	for piece, want := range map[int]torrent.PiecePriority{
+		10: torrent.PiecePriorityNone, 11: torrent.PiecePriorityNone,
+		12: torrent.PiecePriorityNow, 13: torrent.PiecePriorityHigh, 15: torrent.PiecePriorityHigh,
+		30: torrent.PiecePriorityNow, 33: torrent.PiecePriorityHigh,
+	} {
+		if got := priority(piece); got != want {
+			t.Errorf("after a's second seek: piece %d priority %v, want %v", piece, got, want)
+		}
+	}
+
+	// b jumps into a's window: the overlap stays raised when b moves on or ends.
+	tc.prioritizeSeekWindow(b, file, 14*pieceLength, b.window) // pieces 14-17
+	tc.releaseSeekWindow(b)
+	for piece, want := range map[int]torrent.PiecePriority{
+		14: torrent.PiecePriorityNow, 15: torrent.PiecePriorityHigh,
+		16: torrent.PiecePriorityNone, 30: torrent.PiecePriorityNone,
+	} {
+		if got := priority(piece); got != want {
+			t.Errorf("after b ends: piece %d priority %v, want %v", piece, got, want)
+		}
+	}
+}
+
+// /playlist only needs the file list, so it doesn't activate the torrent.
+func TestPlaylistDoesNotActivate(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	mi := writeTestTorrent(t, tc.downloadDir, "Show S01", []testFile{
+		{path: "E02.mkv", size: 16 << 10},
+		{path: "E01.mkv", size: 16 << 10},
+		{path: "show.nfo", size: 1 << 10},
+	})
+	magnet := persistTestTorrent(t, tc, mi)
+	rec := httptest.NewRecorder()
+	tc.playlistHandler(rec, httptest.NewRequest(http.MethodGet, "http://localhost:8080/playlist?url="+url.QueryEscape(magnet), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if tc.cache.Contains(mi.HashInfoBytes().HexString()) {
+		t.Error("/playlist activated the torrent")
+	}
+	for _, torrent := range tc.client.Torrents() {
+		t.Errorf("/playlist left torrent %s in the client", torrent.InfoHash().HexString())
+	}
+	body := rec.Body.String()
+	e01, e02 := strings.Index(body, "#EXTINF:-1,E01.mkv\n"), strings.Index(body, "#EXTINF:-1,E02.mkv\n")
+	if e01 < 0 || e02 < e01 || strings.Contains(body, "show.nfo") {
+		t.Errorf("playlist does not list the episodes in order:\n%s", body)
+	}
+	if !strings.Contains(body, "&index=1\n") {
+		t.Errorf("playlist entries don't use torrent file indexes:\n%s", body)
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename="Show S01.m3u"`; got != want {
+		t.Errorf("Content-Disposition = %s, want %s", got, want)
+	}
+}
+
+func TestSessionDirsCreatedOnAdd(t *testing.T) {
+	tc := newTestClient(t, Options{PerSessionDirs: true})
+	mi := writeTestTorrent(t, t.TempDir(), "film", []testFile{{path: "film.mkv", size: 16 << 10}})
+	magnet := persistTestTorrent(t, tc, mi)
+	request := func(handler http.HandlerFunc, path, sessionID string) int {
+		req := httptest.NewRequest(http.MethodGet, path+"?url="+url.QueryEscape(magnet), nil)
+		req.Header.Set(sessionIDHeader, sessionID)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	// Browsing creates no directory.
+	if code := request(tc.filesHandler, "/files", "alice"); code != http.StatusOK {
+		t.Fatalf("/files: status %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(tc.downloadDir, "alice")); !os.IsNotExist(err) {
+		t.Errorf("/files created the session directory (stat: %v)", err)
+	}
+	if code := request(tc.filesHandler, "/files", "lotusdb_meta"); code != http.StatusBadRequest {
+		t.Errorf("reserved session ID: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// Adding the torrent creates the directory and opens its storage, which is
+	// closed again when the torrent is dropped.
+	dir := filepath.Join(tc.downloadDir, "bob")
+	tor, err := tc.getTorrentFromMagnet(magnet, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		t.Fatalf("session directory not created on add (stat: %v)", err)
+	}
+	openStorages := func() int {
+		tc.sessionStoragesMu.Lock()
+		defer tc.sessionStoragesMu.Unlock()
+		return len(tc.sessionStorages)
+	}
+	if n := openStorages(); n != 1 {
+		t.Fatalf("%d session storages open, want 1", n)
+	}
+	tc.cache.Remove(mi.HashInfoBytes().HexString())
+	tor.Drop()
+	waitFor(t, "the session storage to close", func() bool { return openStorages() == 0 })
+}
+
+// ffmpeg's reads through the internal server aren't held to the public limit.
+func TestInternalStreamIgnoresLimit(t *testing.T) {
+	tc := newTestClient(t, Options{MaxStreamsPerTorrent: 1})
+	if err := tc.startInternalServer(); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 20<<10)
+	rand.Read(data)
+	mi := writeTestTorrent(t, tc.downloadDir, "clip", []testFile{{path: "clip.mkv", data: data}})
+	magnet := persistTestTorrent(t, tc, mi)
+	tor := verifyTestTorrent(t, tc, magnet)
+	entry := tc.cacheEntryFor(tor)
+	if !tc.acquireStream(entry, false) { // A player holds the only public slot.
+		t.Fatal("first stream rejected")
+	}
+	defer tc.releaseStream(entry, false)
+
+	srv := httptest.NewServer(http.HandlerFunc(tc.streamHandler))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/stream?index=0&url=" + url.QueryEscape(magnet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("public stream over the limit: status %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+
+	resp, err = http.Get(tc.internalStreamURL(magnet, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("internal stream: status %d, %d bytes; want 200 with the %d-byte file", resp.StatusCode, len(body), len(data))
+	}
+	if n := activeStreams(t, tc, magnet); n != 1 {
+		t.Errorf("%d streams open after the internal read, want 1", n)
+	}
+}
+
+func TestBatchMetadataBodyLimit(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	body := `["` + strings.Repeat("a", maxBatchBodySize) + `"]`
+	rec := httptest.NewRecorder()
+	tc.batchMetadataHandler(rec, httptest.NewRequest(http.MethodPost, "/metadata/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// A client that disconnects doesn't wait for, or queue, the rest of the batch.
+func TestBatchMetadataStopsWhenCanceled(t *testing.T) {
+	tc := newTestClient(t, Options{MetadataTimeout: time.Minute})
+	var magnets []string
+	for range maxBatchMagnets {
+		var hash [20]byte
+		rand.Read(hash[:])
+		magnets = append(magnets, fmt.Sprintf("magnet:?xt=urn:btih:%x", hash))
+	}
+	body, _ := json.Marshal(magnets)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/metadata/batch", bytes.NewReader(body)).WithContext(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		tc.batchMetadataHandler(httptest.NewRecorder(), req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler still running after the client disconnected")
+	}
+	// Only the items the workers had already taken were added to the client.
+	if n := len(tc.client.Torrents()); n > batchMetadataWorkers {
+		t.Errorf("%d torrents added after cancellation, want at most %d", n, batchMetadataWorkers)
+	}
+}
+
+// /cache/clear leaves a torrent an info fetch is waiting on, and a request whose
+// torrent is dropped anyway gives up at once instead of timing out.
+func TestCacheClearKeepsTorrentsInUse(t *testing.T) {
+	tc := newTestClient(t, Options{MetadataTimeout: time.Minute})
+	var hash [20]byte
+	rand.Read(hash[:])
+	magnet := fmt.Sprintf("magnet:?xt=urn:btih:%x", hash)
+	fetchErr := make(chan error, 1)
+	go func() {
+		_, _, err := tc.getTorrentInfo(magnet, tc.downloadDir)
+		fetchErr <- err
+	}()
+	waitFor(t, "the fetch to add the torrent", func() bool { return len(tc.client.Torrents()) == 1 })
+
+	rec := httptest.NewRecorder()
+	tc.cacheClearHandler(rec, httptest.NewRequest(http.MethodPost, "/cache/clear", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/cache/clear: status %d", rec.Code)
+	}
+	torrents := tc.client.Torrents()
+	if len(torrents) != 1 {
+		t.Fatalf("/cache/clear dropped the torrent being fetched")
+	}
+	select {
+	case err := <-fetchErr:
+		t.Fatalf("fetch ended after /cache/clear: %v", err)
+	default:
+	}
+
+	torrents[0].Drop()
+	select {
+	case err := <-fetchErr:
+		if !errors.Is(err, errTorrentDropped) {
+			t.Errorf("fetch of a dropped torrent: %v, want errTorrentDropped", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetch still waiting after its torrent was dropped")
+	}
+}
+
+func TestParseSeconds(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"90.5", 90.5, true},
+		{"-1", 0, false},
+		{"NaN", 0, false},
+		{"nan", 0, false},
+		{"Inf", 0, false},
+		{"+Inf", 0, false},
+		{"1e400", 0, false},
+		{"abc", 0, false},
+	} {
+		if got, ok := parseSeconds(tt.in); got != tt.want || ok != tt.ok {
+			t.Errorf("parseSeconds(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTranscodeRejectsNonFiniteStart(t *testing.T) {
+	tc := newTestClient(t, Options{EnableTranscode: true, SubtitleExtractionAvailable: true})
+	magnet := "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"
+	for _, start := range []string{"NaN", "Inf", "-Inf", "-5"} {
+		rec := httptest.NewRecorder()
+		tc.transcodeHandler(rec, httptest.NewRequest(http.MethodGet, "/transcode?index=0&start="+url.QueryEscape(start)+"&url="+url.QueryEscape(magnet), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("start=%s: status %d, want %d", start, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestThumbnailRejectsNonFiniteTime(t *testing.T) {
+	tc := newTestClient(t, Options{SubtitleExtractionAvailable: true})
+	magnet := "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"
+	for _, seconds := range []string{"NaN", "Inf", "-Inf", "-1"} {
+		rec := httptest.NewRecorder()
+		tc.thumbnailHandler(rec, httptest.NewRequest(http.MethodGet, "/thumbnail?index=0&time="+url.QueryEscape(seconds)+"&url="+url.QueryEscape(magnet), nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("time=%s: status %d, want %d", seconds, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// Offsets before the start of a file only check the file's own pieces.
+func TestFileRangeCompleteClampsToFile(t *testing.T) {
+	tc := newTestClient(t, Options{})
+	magnet := persistTestTorrent(t, tc, writeTestTorrent(t, tc.downloadDir, "pair", []testFile{
+		{path: "a.mkv", size: 64 << 10},
+		{path: "b.mkv", size: 64 << 10},
+	}))
+	tor := verifyTestTorrent(t, tc, magnet)
+	file := tor.Files()[1]
+	for _, offset := range []int64{math.MinInt64 / 2, -1 << 20, 0} {
+		if !fileRangeComplete(file, offset, 32<<10) {
+			t.Errorf("offset %d: range reported incomplete", offset)
+		}
+	}
+}
@@ -97,10 +97,11 @@ type TorrentClient struct {
 	vttFileMap   map[string]string // New: Map vttKey (filename) to full path for cleanup
 	vttFileMapMu sync.Mutex        // New: Mutex to protect vttFileMap
 	port         int
+	maxTorrentSize int64 // Maximum accepted body size for uploaded .torrent files
 }
 
 // NewTorrentClient initializes the application.
-func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<- bool, port int) (*TorrentClient, error) {
+func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<- bool, port int, maxTorrentSize int64) (*TorrentClient, error) {
 	http.DefaultClient.Transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment, DialContext: (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
 		MaxIdleConns: 100, IdleConnTimeout: 90 * time.Second, TLSHandshakeTimeout: 10 * time.Second,
@@ -151,7 +152,7 @@ func NewTorrentClient(ctx context.Context, downloadDir string, restartChan chan<
 	}
 	// --- End LotusDB Initialization ---
 
-	tc := &TorrentClient{client: client, ctx: ctx, db: db, restartChan: restartChan, downloadDir: absDownloadDir, vttFileMap: make(map[string]string), port: port}
+	tc := &TorrentClient{client: client, ctx: ctx, db: db, restartChan: restartChan, downloadDir: absDownloadDir, vttFileMap: make(map[string]string), port: port, maxTorrentSize: maxTorrentSize}
 
 	// --- LRU Cache Initialization ---
 	lruCache, err := lru.NewWithEvict(2, func(key interface{}, value interface{}) {
@@ -747,8 +748,14 @@ func (tc *TorrentClient) uploadTorrentHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, tc.maxTorrentSize)
 	torrentBytes, err := io.ReadAll(r.Body)
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, fmt.Sprintf("Torrent file exceeds the maximum size of %s", humanReadableSize(maxBytesErr.Limit)), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, fmt.Sprintf("Failed to read torrent file: %v", err), http.StatusInternalServerError)
 		return
 	}
@@ -1037,6 +1044,7 @@ func main() {
 	port := flag.Int("port", 3000, "Port to listen on")
 	downloadDir := flag.String("download-dir", defaultDownloadDir, "Directory to save downloaded files")
 	cleanupInactiveAfter := flag.Duration("cleanup-inactive-after", 30*time.Minute, "Duration after which to clean up inactive torrents (e.g., '30m', '2h'). Set to '0' to disable.")
+	maxTorrentSize := flag.Int64("max-torrent-size", 10<<20, "Maximum size in bytes of an uploaded .torrent file")
 	flag.Parse()
 
 	var err error // Declare err here
@@ -1084,7 +1092,7 @@ func main() {
 		ctx, cancel := context.WithCancel(context.Background())
 		restartChan := make(chan bool, 1)
 
-		client, err := NewTorrentClient(ctx, *downloadDir, restartChan, *port)
+		client, err := NewTorrentClient(ctx, *downloadDir, restartChan, *port, *maxTorrentSize)
 		if err != nil {
 			log.Fatalf("Failed to create torrent client: %v", err)
 		}
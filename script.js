@@ -232,38 +232,29 @@ document.addEventListener('DOMContentLoaded', () => {
   const pollExtractionStatus = (logFile, subtitleFile, index) => {
     extractionInterval = setInterval(async () => {
       try {
-        const response = await fetch(`/subtitles?file=${logFile}`);
+        const response = await fetch(`/extract-status?file=${encodeURIComponent(logFile)}`);
         if (!response.ok) {
           ffmpegLog.textContent = `Log file not found or error reading it.`;
           clearInterval(extractionInterval);
           fetchingText.classList.add('hidden');
           return;
         }
-        const logText = await response.text();
-        if (!logText.trim()) return; // Don't update UI if log is empty
+        const status = await response.json();
 
-        const lines = logText.trim().split('\n');
-        const lastLine = lines[lines.length - 1];
-
-        const progressRegex = new RegExp('size=\\s*(?<size>\\S+)\\s*time=\\s*(?<time>\\S+)\\s*bitrate=\\s*(?<bitrate>\\S+)\\s*speed=\\s*(?<speed>\\S+)');
-        const match = lastLine.match(progressRegex);
-
-        if (logText.includes('Extraction finished successfully')) {
+        if (status.status === 'success') {
           clearInterval(extractionInterval);
           fetchingText.classList.add('hidden');
           fetchingText.style.display = 'none';
           ffmpegLog.style.display = 'none';
           initializeJassub(subtitleFile, index);
-        } else if (logText.includes('Extraction failed')) {
+        } else if (status.status === 'failure' || status.status === 'unknown') {
           clearInterval(extractionInterval);
           fetchingText.classList.add('hidden');
           ffmpegLog.style.display = 'none';
-          ffmpegLog.textContent = `Extraction failed. Last message: ${lastLine}`;
-        } else if (match && match.groups) {
-          const { size, time, bitrate, speed } = match.groups;
-          ffmpegLog.textContent = `Extracting... Size: ${size} | Time: ${time} | Bitrate: ${bitrate} | Speed: ${speed}`;
-        } else {
-          ffmpegLog.textContent = lastLine; // Fallback for non-progress lines
+          ffmpegLog.textContent = `Extraction failed. Last message: ${status.message || ''}`;
+        } else if (status.time) {
+          const percent = status.percent ? ` (${status.percent.toFixed(1)}%)` : '';
+          ffmpegLog.textContent = `Extracting... Size: ${status.size || '?'} | Time: ${status.time}${percent}`;
         }
       } catch (error) {
         console.error('Error polling extraction status:', error);